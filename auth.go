@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type apiToken struct {
+	Token string
+	Write bool
+}
+
+// 未配置时 API 只允许本机访问
+var apiTokens []apiToken
+
+type tokenScope int
+
+const (
+	scopeRead tokenScope = iota
+	scopeWrite
+	// GET/HEAD 只需读权限，其余方法需要写权限
+	scopeByMethod
+)
+
+// 支持 "token"（读写）、"token:read"、"token:write" 和 {"token": "...", "scope": "read"}；
+// 只有以 :read 或 :write 结尾时才作为权限，token 本身可以包含 :
+func parseAPITokens(value interface{}) ([]apiToken, error) {
+	var tokens []apiToken
+	add := func(token, scope string) error {
+		token = strings.TrimSpace(token)
+		if scope == "" {
+			for _, s := range []string{"read", "write"} {
+				if t := strings.TrimSuffix(token, ":"+s); t != token {
+					token, scope = t, s
+					break
+				}
+			}
+		}
+		if token == "" {
+			return errors.New("token 不能为空")
+		}
+		if scope != "" && scope != "read" && scope != "write" {
+			return fmt.Errorf("未知的 token 权限：%q", scope)
+		}
+		tokens = append(tokens, apiToken{Token: token, Write: scope != "read"})
+		return nil
+	}
+	var err error
+	switch v := value.(type) {
+	case nil:
+	case string:
+		if strings.TrimSpace(v) == "" {
+			break
+		}
+		for _, token := range strings.Split(v, ",") {
+			if err = add(token, ""); err != nil {
+				break
+			}
+		}
+	case []string:
+		for _, token := range v {
+			if err = add(token, ""); err != nil {
+				break
+			}
+		}
+	case []interface{}:
+		for _, i := range v {
+			switch t := i.(type) {
+			case string:
+				err = add(t, "")
+			case map[string]interface{}:
+				token, _ := t["token"].(string)
+				scope, _ := t["scope"].(string)
+				if scope == "" {
+					scope = "write"
+				}
+				err = add(token, scope)
+			default:
+				err = fmt.Errorf("无法识别的 token：%v", i)
+			}
+			if err != nil {
+				break
+			}
+		}
+	default:
+		err = fmt.Errorf("无法识别的 apiTokens：%v", v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// 未配置 apiTokens 时 API 只能监听本机地址或 unix socket
+func isLocalAddr(address string) bool {
+	if strings.HasPrefix(address, "unix:") || address == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(address)
+	return ip != nil && ip.IsLoopback()
+}
+
+// 请求是否由反向代理转发
+func forwarded(r *http.Request) bool {
+	for _, header := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Real-Ip"} {
+		if r.Header.Get(header) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// 从 Authorization: Bearer <token> 或 ?token= 中读取
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if token := strings.TrimPrefix(auth, "Bearer "); token != auth {
+			return strings.TrimSpace(token)
+		}
+		return strings.TrimSpace(auth)
+	}
+	return r.URL.Query().Get("token")
+}
+
+// 与 checkUid 相同的返回格式，缺少或错误的 token 返回 401，权限不足返回 403
+func checkToken(w http.ResponseWriter, r *http.Request, scope tokenScope) error {
+	// 未配置 token 时只允许本机的请求，unix socket 由文件权限控制；
+	// 经过反向代理的请求看起来也来自本机，带有转发请求头时不信任
+	if len(apiTokens) == 0 && !forwarded(r) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || isLocalAddr(host) {
+			return nil
+		}
+	}
+	write := scope == scopeWrite ||
+		scope == scopeByMethod && r.Method != http.MethodGet && r.Method != http.MethodHead
+
+	code, status := http.StatusUnauthorized, "token"
+	if token := requestToken(r); token != "" {
+		for _, t := range apiTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+				if !write || t.Write {
+					return nil
+				}
+				code, status = http.StatusForbidden, "scope"
+				break
+			}
+		}
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	result, err := json.Marshal(struct {
+		Code   int    `json:"code"`
+		Status string `json:"status"`
+	}{
+		Code:   code,
+		Status: status,
+	})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	_, err = w.Write(result)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return errors.New("token error")
+}
+
+func requireToken(scope tokenScope, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkToken(w, r, scope); err != nil {
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseAPITokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  []apiToken
+		err   bool
+	}{
+		{"unset", nil, nil, false},
+		{"env", "a, b:read", []apiToken{{"a", true}, {"b", false}}, false},
+		{"colon in token", []string{"a:b", "c:d:read", "e:write"}, []apiToken{{"a:b", true}, {"c:d", false}, {"e", true}}, false},
+		{"config", []interface{}{"a", map[string]interface{}{"token": "b:c", "scope": "read"}}, []apiToken{{"a", true}, {"b:c", false}}, false},
+		{"empty", "a,,b", nil, true},
+		{"empty with scope", []string{":read"}, nil, true},
+		{"unknown scope", []interface{}{map[string]interface{}{"token": "a", "scope": "admin"}}, nil, true},
+		{"missing token", []interface{}{map[string]interface{}{"scope": "read"}}, nil, true},
+		{"unknown type", []interface{}{1}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAPITokens(tt.value)
+			if (err != nil) != tt.err || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAPITokens(%v) = %v, %v, want %v, error %v", tt.value, got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	defer func(tokens []apiToken) { apiTokens = tokens }(apiTokens)
+	tests := []struct {
+		tokens []apiToken
+		remote string
+		method string
+		token  string
+		scope  tokenScope
+		code   int
+	}{
+		{nil, "127.0.0.1:1234", http.MethodPost, "", scopeWrite, http.StatusOK},
+		{nil, "[::1]:1234", http.MethodGet, "", scopeRead, http.StatusOK},
+		{nil, "192.168.1.2:1234", http.MethodGet, "", scopeRead, http.StatusUnauthorized},
+		{[]apiToken{{"a", false}}, "127.0.0.1:1234", http.MethodGet, "", scopeRead, http.StatusUnauthorized},
+		{[]apiToken{{"a", false}}, "192.168.1.2:1234", http.MethodGet, "a", scopeByMethod, http.StatusOK},
+		{[]apiToken{{"a", false}}, "192.168.1.2:1234", http.MethodDelete, "a", scopeByMethod, http.StatusForbidden},
+		{[]apiToken{{"a", true}}, "192.168.1.2:1234", http.MethodDelete, "a", scopeByMethod, http.StatusOK},
+		{[]apiToken{{"a", true}}, "192.168.1.2:1234", http.MethodGet, "b", scopeRead, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		apiTokens = tt.tokens
+		r := httptest.NewRequest(tt.method, "/entries", nil)
+		r.RemoteAddr = tt.remote
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		checkToken(w, r, tt.scope)
+		if w.Code != tt.code {
+			t.Errorf("%s %s from %s with %q: %d, want %d", tt.method, r.URL, tt.remote, tt.token, w.Code, tt.code)
+		}
+	}
+	// 反向代理转发的请求不视为本机请求
+	apiTokens = nil
+	for _, header := range []string{"Forwarded", "X-Forwarded-For", "X-Real-IP"} {
+		for _, remote := range []string{"127.0.0.1:1234", "@"} {
+			r := httptest.NewRequest(http.MethodGet, "/list", nil)
+			r.RemoteAddr = remote
+			r.Header.Set(header, "203.0.113.1")
+			w := httptest.NewRecorder()
+			checkToken(w, r, scopeRead)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("request from %s with %s: %d, want 401", remote, header, w.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const textBundleInfo = `{"transient":true,"type":"net.daringfireball.markdown","creatorIdentifier":"pro.simpread","version":2}`
+
+// enhancedOutput 中是否配置了 extension
+func hasOutput(extension string) bool {
+	for _, i := range enhancedOutput {
+		if i["extension"] == extension {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回检查文件夹是否为本工具导出的函数：文件夹中只有 files 和存放图片的 assets，且 files 都存在
+func bundleLayout(files ...string) func(dir string) bool {
+	return func(dir string) bool {
+		info, err := os.Lstat(dir)
+		if err != nil || !info.IsDir() {
+			return false
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return false
+		}
+		found := 0
+		for _, entry := range entries {
+			switch {
+			case entry.Name() == "assets" && entry.IsDir():
+				assets, err := os.ReadDir(filepath.Join(dir, "assets"))
+				if err != nil {
+					return false
+				}
+				for _, asset := range assets {
+					if !asset.Type().IsRegular() {
+						return false
+					}
+				}
+			case contains(files, entry.Name()) && entry.Type().IsRegular():
+				found++
+			default:
+				return false
+			}
+		}
+		return found == len(files)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, i := range list {
+		if i == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 在 dir 写入 textbundle 文件夹
+func writeTextBundle(dir, content string, images *articleImages) ([]imageResult, error) {
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	content, results, err := images.localize(content, dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filepath.Join(dir, "info.json"), []byte(textBundleInfo), 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filepath.Join(dir, "text.markdown"), []byte(content), 0644)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// 写入 textpack 文件 file，即压缩后的 <title>.textbundle
+func writeTextPack(file, title, content string, images *articleImages) ([]imageResult, error) {
+	content, results, assets := images.rewrite(content)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	root := safeName(title+".textbundle") + "/"
+	now := time.Now()
+	add := func(name string, data []byte) error {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: root + name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	err := add("info.json", []byte(textBundleInfo))
+	if err != nil {
+		return nil, err
+	}
+	err = add("text.markdown", []byte(content))
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range assets {
+		err = add("assets/"+image.name, image.body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return results, writeFileAtomic(file, buf.Bytes(), 0644)
+}
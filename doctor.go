@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/gomail.v2"
+)
+
+// 一项检查的结果，status 为 ok、warn（功能受限）或 fail（需要处理）
+type check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type checker struct {
+	checks []check
+}
+
+func (c *checker) add(name, status, format string, a ...interface{}) {
+	c.checks = append(c.checks, check{Name: name, Status: status, Detail: fmt.Sprintf(format, a...)})
+}
+
+func (c *checker) failed() bool {
+	for _, check := range c.checks {
+		if check.Status == "fail" {
+			return true
+		}
+	}
+	return false
+}
+
+// full 为 false 时跳过 SMTP 登录和端口检查，用于启动时的摘要
+func runChecks(full bool) []check {
+	c := &checker{}
+	c.checkConfig()
+	c.checkDir("syncPath", syncPath)
+	c.checkDir("outputPath", outputPath)
+	c.checkEnhancedOutput()
+	c.checkPandoc()
+	c.checkPDF()
+	c.checkTLS()
+	c.checkMail(full)
+	if full {
+		c.checkPort("port", listenAddr, port)
+		if !disableAPI {
+			c.checkPort("apiPort", apiListenAddr, apiPort)
+		}
+	}
+	return c.checks
+}
+
+func (c *checker) checkConfig() {
+	file := viper.ConfigFileUsed()
+	if _, err := os.Stat(file); err == nil {
+		c.add("config", "ok", "%s", file)
+	} else if configFile != "" {
+		c.add("config", "fail", "%v", err)
+	} else {
+		c.add("config", "ok", "未使用配置文件")
+	}
+	config, err := store.LoadConfig()
+	if os.IsNotExist(err) {
+		c.add("simpread_config.json", "warn", "不存在，等待浏览器插件同步")
+	} else if err != nil {
+		c.add("simpread_config.json", "fail", "%v", err)
+	} else {
+		c.add("simpread_config.json", "ok", "%d 篇稍后读", len(config.Unrdist))
+	}
+	if uid == "" {
+		c.add("uid", "warn", "未设置，需要先在浏览器插件中验证")
+	}
+	if !disableAPI && len(apiTokens) == 0 {
+		c.add("apiTokens", "warn", "未配置，API 只允许本机访问")
+	}
+}
+
+// 目录需要存在并且可写
+func (c *checker) checkDir(name, dir string) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		c.add(name, "fail", "%v", err)
+		return
+	}
+	if !info.IsDir() {
+		c.add(name, "fail", "%s 不是文件夹", dir)
+		return
+	}
+	f, err := os.CreateTemp(dir, ".simpread-doctor-*")
+	if err != nil {
+		c.add(name, "fail", "%s 不可写：%v", dir, err)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+	c.add(name, "ok", "%s", dir)
+}
+
+// 不存在的目录会在导出时创建，只检查能否创建
+func (c *checker) checkEnhancedOutput() {
+	seen := map[string]bool{}
+	for _, i := range enhancedOutput {
+		ext := i["extension"]
+		name := "enhancedOutput." + ext
+		if ext == "" {
+			c.add("enhancedOutput", "fail", "缺少 extension：%v", i)
+			continue
+		}
+		for key := range i {
+			if key != "extension" && key != "path" && key != "template" {
+				c.add(name, "warn", "未知的字段：%s", key)
+			}
+		}
+		path := i["path"]
+		if path == "" {
+			path = filepath.Join(outputPath, ext)
+		}
+		if seen[ext+"\x00"+path] {
+			c.add(name, "warn", "重复的配置：%s", path)
+			continue
+		}
+		seen[ext+"\x00"+path] = true
+		if _, err := os.Stat(path); err == nil {
+			c.checkDir(name, path)
+			continue
+		}
+		parent := filepath.Dir(path)
+		for {
+			if _, err := os.Stat(parent); err == nil || parent == filepath.Dir(parent) {
+				break
+			}
+			parent = filepath.Dir(parent)
+		}
+		if f, err := os.CreateTemp(parent, ".simpread-doctor-*"); err == nil {
+			f.Close()
+			os.Remove(f.Name())
+			c.add(name, "warn", "%s 不存在，导出时创建", path)
+		} else {
+			c.add(name, "fail", "%s 不存在且无法创建：%v", path, err)
+		}
+	}
+}
+
+func (c *checker) checkPandoc() {
+	formats := []string{""}
+	for format := range converters {
+		formats = append(formats, format)
+	}
+	for _, format := range formats {
+		name := "pandoc"
+		if format != "" {
+			name = "converters." + format
+		}
+		bin, err := converters[format].pandoc()
+		if err != nil && format != "" {
+			c.add(name, "fail", "%v", err)
+			continue
+		} else if err != nil && epubBackend == "pandoc" {
+			c.add(name, "fail", "%v，epubBackend 为 pandoc", err)
+			continue
+		} else if err != nil {
+			c.add(name, "warn", "%v，只能使用内置的 EPUB 导出", err)
+			continue
+		}
+		c.checkVersion(name, bin)
+	}
+}
+
+func (c *checker) checkPDF() {
+	if pdfBackend == "native" {
+		fonts := findFonts(fontDirPath())
+		if fonts.regular == "" {
+			c.add("fontDir", "warn", "%s 中没有可用的字体，只能显示西文", fontDirPath())
+		} else {
+			c.add("fontDir", "ok", "%s", filepath.Base(fonts.regular))
+		}
+		return
+	}
+	for _, bin := range wkhtmltopdfBins {
+		path, err := exec.LookPath(bin)
+		if err != nil {
+			c.add("wkhtmltopdf", "warn", "%v，无法导出 PDF", err)
+			continue
+		}
+		c.checkVersion("wkhtmltopdf", path)
+	}
+}
+
+// 运行 bin --version，取第一行作为版本
+func (c *checker) checkVersion(name, bin string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, bin, "--version")
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		c.add(name, "fail", "%s：%v", bin, err)
+		return
+	}
+	version, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	c.add(name, "ok", "%s（%s）", bin, strings.TrimSpace(version))
+}
+
+func (c *checker) checkTLS() {
+	if certFile == "" && keyFile == "" {
+		return
+	}
+	if selfSigned {
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			c.add("tls", "ok", "启动时生成自签名证书")
+			return
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		c.add("tls", "fail", "%v", err)
+		return
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		c.add("tls", "fail", "%v", err)
+		return
+	}
+	if time.Now().After(leaf.NotAfter) {
+		c.add("tls", "fail", "证书已于 %s 过期", leaf.NotAfter.Format("2006-01-02"))
+	} else if time.Until(leaf.NotAfter) < 30*24*time.Hour {
+		c.add("tls", "warn", "证书将于 %s 过期", leaf.NotAfter.Format("2006-01-02"))
+	} else {
+		c.add("tls", "ok", "证书有效期至 %s", leaf.NotAfter.Format("2006-01-02"))
+	}
+}
+
+// login 为 true 时连接 SMTP 服务器并登录
+func (c *checker) checkMail(login bool) {
+	if smtpHost == "" {
+		c.add("smtp", "warn", "未配置 smtpHost，无法发送邮件")
+		return
+	}
+	if receiverMail == "" && kindleMail == "" {
+		c.add("smtp", "warn", "未配置 receiverMail 和 kindleMail")
+	}
+	if !login {
+		return
+	}
+	d := gomail.NewDialer(smtpHost, smtpPort, smtpUsername, smtpPassword)
+	d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	s, err := d.Dial()
+	if err != nil {
+		c.add("smtp", "fail", "%s:%d：%v", smtpHost, smtpPort, err)
+		return
+	}
+	s.Close()
+	c.add("smtp", "ok", "%s:%d 登录成功", smtpHost, smtpPort)
+}
+
+// 端口被占用时可能是服务已经在运行，只作为警告
+func (c *checker) checkPort(name, address string, port int) {
+	if socket := strings.TrimPrefix(address, "unix:"); socket != address {
+		// listen 会删除已有的 socket 文件，这里只尝试连接
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			c.add(name, "warn", "%s 已被占用", address)
+		} else {
+			c.add(name, "ok", "%s", address)
+		}
+		return
+	}
+	addr := net.JoinHostPort(address, fmt.Sprint(port))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		c.add(name, "warn", "%v", err)
+		return
+	}
+	ln.Close()
+	c.add(name, "ok", "%s", addr)
+}
+
+// 启动时只输出有问题的检查项
+func logStartupChecks() {
+	warn, fail := 0, 0
+	for _, check := range runChecks(false) {
+		switch check.Status {
+		case "warn":
+			warn++
+			log.Printf("[warn] %s：%s", check.Name, check.Detail)
+		case "fail":
+			fail++
+			log.Printf("[fail] %s：%s", check.Name, check.Detail)
+		}
+	}
+	log.Printf("启动检查：%d 项警告，%d 项错误，可运行 simpread-sync doctor 查看详情", warn, fail)
+}
+
+var doctorJSON bool
+
+var doctorCmd = &cobra.Command{
+	Use:                "doctor",
+	Short:              "check dependencies, directories, smtp, ports and config",
+	Args:               cobra.NoArgs,
+	FParseErrWhitelist: pathFlagsWhitelist,
+	PreRun:             preRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := &checker{checks: runChecks(true)}
+		if doctorJSON {
+			data, err := json.MarshalIndent(struct {
+				OK     bool    `json:"ok"`
+				Checks []check `json:"checks"`
+			}{OK: !c.failed(), Checks: c.checks}, "", "  ")
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(string(data))
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			for _, check := range c.checks {
+				fmt.Fprintf(w, "[%s]\t%s\t%s\n", check.Status, check.Name, check.Detail)
+			}
+			w.Flush()
+		}
+		if c.failed() {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	doctorCmd.Flags().BoolVar(&doctorJSON, "json", false, "print results as json")
+	rootCmd.AddCommand(doctorCmd)
+}
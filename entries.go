@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PATCH 请求体，未出现的字段保持不变
+type unrdPatch struct {
+	Idx     int       `json:"idx"`
+	Title   *string   `json:"title"`
+	URL     *string   `json:"url"`
+	Desc    *string   `json:"desc"`
+	Note    *string   `json:"note"`
+	Tags    *[]string `json:"tags"`
+	Favicon *string   `json:"favicon"`
+	Img     *string   `json:"img"`
+}
+
+func (p *unrdPatch) apply(u *Unrd) {
+	if p.Title != nil {
+		u.Title = *p.Title
+	}
+	if p.URL != nil {
+		u.URL = *p.URL
+	}
+	if p.Desc != nil {
+		u.Desc = *p.Desc
+	}
+	if p.Note != nil {
+		u.Note = *p.Note
+	}
+	if p.Tags != nil {
+		u.Tags = *p.Tags
+		if u.Tags == nil {
+			u.Tags = []string{}
+		}
+	}
+	if p.Favicon != nil {
+		u.Favicon = *p.Favicon
+	}
+	if p.Img != nil {
+		u.Img = *p.Img
+	}
+}
+
+var errEntryNotFound = errors.New("没有找到对应的内容")
+
+func parseIdxList(s string) ([]int, error) {
+	var idxs []int
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		idx, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid idx: %q", v)
+		}
+		idxs = append(idxs, idx)
+	}
+	if len(idxs) == 0 {
+		return nil, errors.New("missing idx")
+	}
+	return idxs, nil
+}
+
+func getEntries(idxs []int) ([]*Unrd, error) {
+	config, err := store.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*Unrd, 0, len(idxs))
+	for _, idx := range idxs {
+		_, u := config.Find(idx)
+		if u == nil {
+			return nil, fmt.Errorf("%w: %d", errEntryNotFound, idx)
+		}
+		entries = append(entries, u)
+	}
+	return entries, nil
+}
+
+// 任一 idx 不存在时不做任何修改
+func patchEntries(patches []unrdPatch) ([]*Unrd, error) {
+	var entries []*Unrd
+	err := store.UpdateConfig(func(config *Config) error {
+		entries = make([]*Unrd, 0, len(patches))
+		for _, p := range patches {
+			_, u := config.Find(p.Idx)
+			if u == nil {
+				return fmt.Errorf("%w: %d", errEntryNotFound, p.Idx)
+			}
+			p.apply(u)
+			entries = append(entries, u)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// archive 为 true 时只从 unrdist 中移除，不清理导出文件
+func deleteEntries(idxs []int, archive bool) error {
+	err := store.UpdateConfig(func(config *Config) error {
+		for _, idx := range idxs {
+			i, _ := config.Find(idx)
+			if i < 0 {
+				return fmt.Errorf("%w: %d", errEntryNotFound, idx)
+			}
+			config.Unrdist = append(config.Unrdist[:i], config.Unrdist[i+1:]...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if autoRemove && !archive {
+		for _, idx := range idxs {
+			removeOutputFiles(idx)
+		}
+	}
+	return nil
+}
+
+func writeEntryError(w http.ResponseWriter, err error) {
+	code := http.StatusBadRequest
+	if errors.Is(err, errEntryNotFound) {
+		code = http.StatusNotFound
+	}
+	writeAPIError(w, code, err.Error())
+}
+
+// /entries/{idx}     GET 获取、PATCH 修改、DELETE 删除（?archive=true 时保留导出文件）
+// /entries?idx=1,2   GET 批量获取、DELETE 批量删除
+// /entries           PATCH 批量修改，请求体为带 idx 的数组
+func APIentriesHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	// PATCH 的请求体是 json，参数只从 query 中读取
+	query := r.URL.Query()
+	var idxs []int
+	var err error
+	single := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/entries"), "/")
+	if single != "" {
+		idxs, err = parseIdxList(single)
+		if err == nil && len(idxs) != 1 {
+			err = fmt.Errorf("invalid idx: %q", single)
+		}
+	} else if r.Method != http.MethodPatch {
+		idxs, err = parseIdxList(query.Get("idx"))
+	}
+	if err != nil {
+		writeEntryError(w, err)
+		return
+	}
+
+	var data interface{}
+	switch r.Method {
+	case http.MethodGet:
+		var entries []*Unrd
+		entries, err = getEntries(idxs)
+		data = entries
+		if single != "" && err == nil {
+			data = entries[0]
+		}
+	case http.MethodPatch:
+		var body []byte
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			break
+		}
+		var patches []unrdPatch
+		if single != "" {
+			var patch unrdPatch
+			err = json.Unmarshal(body, &patch)
+			patch.Idx = idxs[0]
+			patches = append(patches, patch)
+		} else {
+			err = json.Unmarshal(body, &patches)
+			for _, patch := range patches {
+				idxs = append(idxs, patch.Idx)
+			}
+		}
+		if err != nil {
+			break
+		}
+		var entries []*Unrd
+		entries, err = patchEntries(patches)
+		data = entries
+		if single != "" && err == nil {
+			data = entries[0]
+		}
+		if err == nil {
+			log.Println("API patch entries:", idxs)
+		}
+	case http.MethodDelete:
+		archive, _ := strconv.ParseBool(query.Get("archive"))
+		err = deleteEntries(idxs, archive)
+		if err == nil {
+			log.Println("API delete entries:", idxs)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PATCH, DELETE")
+		writeAPIError(w, http.StatusMethodNotAllowed, r.Method+" "+r.URL.Path)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeEntryError(w, err)
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, data)
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"html"
+	"log"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	nethtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// auto 时找不到 pandoc 才使用内置的 EPUB 导出
+var epubBackend string
+
+func validEPUBBackend(backend string) bool {
+	switch backend {
+	case "auto", "pandoc", "native":
+		return true
+	}
+	return false
+}
+
+var matchXMLName = regexp.MustCompile(`^[A-Za-z_][-A-Za-z0-9_.]*$`)
+
+// 内置 EPUB 导出使用的元数据
+type epubMeta struct {
+	Title    string
+	Author   string
+	Source   string
+	Language string
+	Cover    string // 封面图片的链接，为空时使用文章中的第一张图片
+}
+
+type epubHeading struct {
+	id    string
+	level int
+	text  string
+}
+
+var epubMediaTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".svg":  "image/svg+xml",
+	".bmp":  "image/bmp",
+	".avif": "image/avif",
+	".ico":  "image/vnd.microsoft.icon",
+}
+
+const epubStyle = `body { font-family: serif; line-height: 1.6; margin: 0 5%; }
+h1, h2, h3, h4, h5, h6 { font-family: sans-serif; line-height: 1.3; }
+img { max-width: 100%; height: auto; }
+pre { white-space: pre-wrap; background: #f5f5f5; padding: 0.5em; font-size: 0.85em; }
+code { font-family: monospace; }
+blockquote { margin: 1em 0; padding-left: 1em; border-left: 3px solid #ccc; color: #555; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.5em; }
+.source { font-size: 0.85em; color: #777; word-break: break-all; }
+`
+
+// in 为 md 时先转换为 HTML；content 中的图片下载后放入 EPUB，ctx 结束时停止
+func renderNativeEPUB(ctx context.Context, content, in string, meta epubMeta) ([]byte, []imageResult, error) {
+	images := downloadImages(ctx, content, meta.Source)
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	content, results, assets := images.rewrite(content)
+	if in == "md" || in == "markdown" {
+		content = markdownToHTML(content)
+	}
+
+	body, headings, err := epubXHTML(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.Language == "" {
+		meta.Language = guessLanguage(content)
+	}
+
+	cover := ""
+	if meta.Cover != "" {
+		image, err := fetchCover(ctx, meta.Cover, meta.Source)
+		if err != nil {
+			log.Println("下载封面失败：", err)
+		} else {
+			cover = "assets/" + image.name
+			assets = appendAsset(assets, image)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if cover == "" {
+		for _, image := range assets {
+			if _, ok := epubMediaTypes[path.Ext(image.name)]; ok && path.Ext(image.name) != ".svg" {
+				cover = "assets/" + image.name
+				break
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	// mimetype 必须是第一个且不压缩
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = w.Write([]byte("application/epub+zip"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := []struct {
+		name string
+		data string
+	}{
+		{"META-INF/container.xml", epubContainer},
+		{"OEBPS/content.opf", epubPackage(meta, assets, cover)},
+		{"OEBPS/nav.xhtml", epubNav(meta, headings)},
+		{"OEBPS/style.css", epubStyle},
+		{"OEBPS/text.xhtml", epubText(meta, body)},
+	}
+	if cover != "" {
+		files = append(files, struct {
+			name string
+			data string
+		}{"OEBPS/cover.xhtml", epubCover(meta, cover)})
+	}
+	for _, file := range files {
+		w, err := zw.Create(file.name)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = w.Write([]byte(file.data))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, image := range assets {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: "OEBPS/assets/" + image.name, Method: zip.Store})
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = w.Write(image.body)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), results, nil
+}
+
+func appendAsset(assets []fetchedImage, image fetchedImage) []fetchedImage {
+	for _, a := range assets {
+		if a.name == image.name {
+			return assets
+		}
+	}
+	return append(assets, image)
+}
+
+func fetchCover(ctx context.Context, raw, base string) (fetchedImage, error) {
+	var baseURL *url.URL
+	if u, err := url.Parse(base); err == nil && u.IsAbs() {
+		baseURL = u
+	}
+	src := resolveImageURL(raw, baseURL)
+	if src == "" {
+		return fetchedImage{}, fmt.Errorf("unsupported cover: %q", raw)
+	}
+	var body []byte
+	var contentType string
+	var err error
+	if strings.HasPrefix(src, "data:") {
+		body, contentType, err = decodeDataURI(src)
+	} else {
+		body, contentType, err = fetchImage(ctx, src)
+	}
+	if err != nil {
+		return fetchedImage{}, err
+	}
+	return fetchedImage{body: body, name: assetName(body, contentType, src)}, nil
+}
+
+// 含有中日韩文字时为 zh，否则为 en
+func guessLanguage(content string) string {
+	for _, r := range content {
+		if unicode.Is(unicode.Han, r) {
+			return "zh"
+		}
+	}
+	return "en"
+}
+
+// 将 HTML 转换为 XHTML 的 body 内容，去掉脚本等内容，为标题加上 id 用于目录
+func epubXHTML(content string) (string, []epubHeading, error) {
+	doc, err := nethtml.Parse(strings.NewReader(content))
+	if err != nil {
+		return "", nil, err
+	}
+	// 生成的 id 不能和文章里已有的 id 重复
+	used := map[string]bool{}
+	var collect func(n *nethtml.Node)
+	collect = func(n *nethtml.Node) {
+		if id := attr(n, "id"); id != "" {
+			used[id] = true
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			collect(c)
+		}
+	}
+	collect(doc)
+	var body *nethtml.Node
+	var headings []epubHeading
+	var walk func(n *nethtml.Node)
+	walk = func(n *nethtml.Node) {
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			if c.Type == nethtml.ElementNode {
+				switch c.DataAtom {
+				case atom.Script, atom.Style, atom.Noscript, atom.Iframe, atom.Object, atom.Embed, atom.Form, atom.Link, atom.Meta, atom.Svg, atom.Math:
+					n.RemoveChild(c)
+					c = next
+					continue
+				case atom.Body:
+					body = c
+				case atom.H1, atom.H2, atom.H3:
+					id := attr(c, "id")
+					if id == "" {
+						for i := len(headings) + 1; id == "" || used[id]; i++ {
+							id = fmt.Sprint("toc-h", i)
+						}
+						used[id] = true
+						c.Attr = append(c.Attr, nethtml.Attribute{Key: "id", Val: id})
+					}
+					if text := strings.Join(strings.Fields(textContent(c)), " "); text != "" {
+						headings = append(headings, epubHeading{id: id, level: int(c.Data[1] - '0'), text: text})
+					}
+				}
+				// 去掉事件处理和不符合 XML 的属性
+				attrs := c.Attr[:0]
+				for _, a := range c.Attr {
+					if !strings.HasPrefix(strings.ToLower(a.Key), "on") && matchXMLName.MatchString(a.Key) {
+						attrs = append(attrs, a)
+					}
+				}
+				c.Attr = attrs
+			}
+			walk(c)
+			c = next
+		}
+	}
+	walk(doc)
+	if body == nil {
+		return "", headings, nil
+	}
+	var b strings.Builder
+	for c := body.FirstChild; c != nil; c = c.NextSibling {
+		err := nethtml.Render(&b, c)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return b.String(), headings, nil
+}
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+func epubPackage(meta epubMeta, assets []fetchedImage, cover string) string {
+	esc := html.EscapeString
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid" xml:lang="` + esc(meta.Language) + `">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">urn:uuid:` + newUUID() + `</dc:identifier>
+    <dc:title>` + esc(meta.Title) + `</dc:title>
+    <dc:language>` + esc(meta.Language) + `</dc:language>
+`)
+	if meta.Author != "" {
+		b.WriteString(`    <dc:creator>` + esc(meta.Author) + "</dc:creator>\n")
+	}
+	if meta.Source != "" {
+		b.WriteString(`    <dc:source>` + esc(meta.Source) + "</dc:source>\n")
+	}
+	b.WriteString(`    <dc:publisher>simpread-sync</dc:publisher>
+    <meta property="dcterms:modified">` + time.Now().UTC().Format("2006-01-02T15:04:05Z") + "</meta>\n")
+	if cover != "" {
+		b.WriteString(`    <meta name="cover" content="` + esc(epubItemID(cover)) + "\"/>\n")
+	}
+	b.WriteString(`  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="style" href="style.css" media-type="text/css"/>
+    <item id="text" href="text.xhtml" media-type="application/xhtml+xml"/>
+`)
+	if cover != "" {
+		b.WriteString(`    <item id="cover" href="cover.xhtml" media-type="application/xhtml+xml"/>` + "\n")
+	}
+	for _, image := range assets {
+		href := "assets/" + image.name
+		mediaType, ok := epubMediaTypes[path.Ext(image.name)]
+		if !ok {
+			mediaType = "application/octet-stream"
+		}
+		properties := ""
+		if href == cover {
+			properties = ` properties="cover-image"`
+		}
+		fmt.Fprintf(&b, "    <item id=\"%s\" href=\"%s\" media-type=\"%s\"%s/>\n", esc(epubItemID(href)), esc(href), mediaType, properties)
+	}
+	b.WriteString("  </manifest>\n  <spine>\n")
+	if cover != "" {
+		b.WriteString(`    <itemref idref="cover" linear="no"/>` + "\n")
+	}
+	b.WriteString(`    <itemref idref="text"/>
+  </spine>
+</package>
+`)
+	return b.String()
+}
+
+func epubItemID(href string) string {
+	return "img-" + strings.TrimSuffix(filepath.Base(href), path.Ext(href))
+}
+
+func epubXHTMLPage(meta epubMeta, title, body string, epubType bool) string {
+	ns := ""
+	if epubType {
+		ns = ` xmlns:epub="http://www.idpf.org/2007/ops"`
+	}
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml"` + ns + ` xml:lang="` + html.EscapeString(meta.Language) + `" lang="` + html.EscapeString(meta.Language) + `">
+<head>
+<meta charset="UTF-8"/>
+<title>` + html.EscapeString(title) + `</title>
+<link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+` + body + `
+</body>
+</html>
+`
+}
+
+func epubText(meta epubMeta, body string) string {
+	var b strings.Builder
+	b.WriteString("<h1 class=\"title\">" + html.EscapeString(meta.Title) + "</h1>\n")
+	if meta.Source != "" {
+		b.WriteString(`<p class="source"><a href="` + html.EscapeString(meta.Source) + `">` + html.EscapeString(meta.Source) + "</a></p>\n")
+	}
+	b.WriteString(body)
+	return epubXHTMLPage(meta, meta.Title, b.String(), false)
+}
+
+func epubNav(meta epubMeta, headings []epubHeading) string {
+	var b strings.Builder
+	b.WriteString("<nav epub:type=\"toc\" id=\"toc\">\n<h1>" + html.EscapeString(meta.Title) + "</h1>\n")
+	if len(headings) == 0 {
+		b.WriteString(`<ol><li><a href="text.xhtml">` + html.EscapeString(meta.Title) + "</a></li></ol>\n</nav>")
+		return epubXHTMLPage(meta, meta.Title, b.String(), true)
+	}
+	// 按标题层级嵌套，跳级时只深入一级
+	depth := 0
+	for _, h := range headings {
+		level := h.level
+		if level > depth+1 {
+			level = depth + 1
+		}
+		if level > depth {
+			b.WriteString("\n<ol>\n")
+			depth = level
+		} else {
+			b.WriteString("</li>\n")
+			for ; depth > level; depth-- {
+				b.WriteString("</ol>\n</li>\n")
+			}
+		}
+		b.WriteString(`<li><a href="text.xhtml#` + html.EscapeString(h.id) + `">` + html.EscapeString(h.text) + "</a>")
+	}
+	b.WriteString("</li>\n")
+	for ; depth > 1; depth-- {
+		b.WriteString("</ol>\n</li>\n")
+	}
+	b.WriteString("</ol>\n</nav>")
+	return epubXHTMLPage(meta, meta.Title, b.String(), true)
+}
+
+func epubCover(meta epubMeta, cover string) string {
+	body := `<div style="text-align:center"><img src="` + html.EscapeString(cover) + `" alt="` + html.EscapeString(meta.Title) + `" style="max-height:100%"/></div>`
+	return epubXHTMLPage(meta, meta.Title, body, false)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEpubXHTML(t *testing.T) {
+	content := `<h1>一</h1><p id="toc-h2">已有</p><h2 id="x">二</h2><h2>三</h2><script>alert(1)</script><h3 onclick="x">四</h3>`
+	body, headings, err := epubXHTML(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, h := range headings {
+		ids = append(ids, h.id)
+	}
+	// 已有的 id 保留，生成的 id 跳过文章里已经用过的
+	if got := strings.Join(ids, ","); got != "toc-h1,x,toc-h3,toc-h4" {
+		t.Errorf("heading ids = %s", got)
+	}
+	if strings.Count(body, `id="toc-h2"`) != 1 || strings.Contains(body, "<script") || strings.Contains(body, "onclick") {
+		t.Errorf("epubXHTML body = %s", body)
+	}
+}
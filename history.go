@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tidwall/gjson"
+)
+
+var historyLimit int
+
+const revisionLayout = "20060102-150405.000"
+
+type revision struct {
+	Rev   string    `json:"rev"`
+	Time  time.Time `json:"time"`
+	Size  int64     `json:"size"`
+	Count int       `json:"count"`
+}
+
+func historyPath() string {
+	return filepath.Join(syncPath, "history")
+}
+
+// 保存一份 simpread_config.json 的历史版本，超出 historyLimit 的旧版本会被删除
+func snapshotConfig(config []byte) error {
+	if historyLimit <= 0 || len(config) == 0 {
+		return nil
+	}
+	err := os.MkdirAll(historyPath(), 0755)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	rev := now.Format(revisionLayout)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(historyPath(), rev+".json")); os.IsNotExist(err) {
+			break
+		}
+		rev = fmt.Sprint(now.Format(revisionLayout), "-", i)
+	}
+	err = writeFileAtomic(filepath.Join(historyPath(), rev+".json"), config, 0644)
+	if err != nil {
+		return err
+	}
+	return pruneRevisions()
+}
+
+func pruneRevisions() error {
+	revisions, err := listRevisions()
+	if err != nil {
+		return err
+	}
+	for i := historyLimit; i < len(revisions); i++ {
+		err := os.Remove(filepath.Join(historyPath(), revisions[i].Rev+".json"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 按时间从新到旧排列
+func listRevisions() ([]revision, error) {
+	fileInfo, err := os.ReadDir(historyPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var revisions []revision
+	for _, file := range fileInfo {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		rev := strings.TrimSuffix(file.Name(), ".json")
+		if len(rev) < len(revisionLayout) {
+			continue
+		}
+		t, err := time.ParseInLocation(revisionLayout, rev[:len(revisionLayout)], time.Local)
+		if err != nil {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return nil, err
+		}
+		config, err := os.ReadFile(filepath.Join(historyPath(), file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision{
+			Rev:   rev,
+			Time:  t,
+			Size:  info.Size(),
+			Count: len(gjson.GetBytes(config, "unrdist").Array()),
+		})
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Rev > revisions[j].Rev
+	})
+	return revisions, nil
+}
+
+func loadRevision(rev string) ([]byte, error) {
+	if rev == "" || strings.ContainsAny(rev, `/\`) || strings.Contains(rev, "..") {
+		return nil, fmt.Errorf("invalid revision: %q", rev)
+	}
+	config, err := os.ReadFile(filepath.Join(historyPath(), rev+".json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("revision not found: %s", rev)
+	}
+	return config, err
+}
+
+// 恢复前的内容同样会被保存为一个历史版本
+func restoreRevision(rev string) error {
+	config, err := loadRevision(rev)
+	if err != nil {
+		return err
+	}
+	parsed, err := parseConfig(config)
+	if err != nil {
+		return err
+	}
+	return store.Update(func([]byte) ([]byte, error) {
+		unrdist = parsed.IdxSet()
+		return config, nil
+	})
+}
+
+type unrdistDiff struct {
+	Added   []unrdistDiffItem `json:"added"`
+	Removed []unrdistDiffItem `json:"removed"`
+}
+
+type unrdistDiffItem struct {
+	Idx   int    `json:"idx"`
+	Title string `json:"title"`
+}
+
+// 比较两份配置中 unrdist 的 idx
+func diffUnrdist(from, to []byte) unrdistDiff {
+	index := func(config []byte) map[int]gjson.Result {
+		m := map[int]gjson.Result{}
+		for _, unrd := range gjson.GetBytes(config, "unrdist").Array() {
+			m[int(unrd.Get("idx").Int())] = unrd
+		}
+		return m
+	}
+	fromIndex, toIndex := index(from), index(to)
+	diff := unrdistDiff{Added: []unrdistDiffItem{}, Removed: []unrdistDiffItem{}}
+	for idx, unrd := range toIndex {
+		if _, ok := fromIndex[idx]; !ok {
+			diff.Added = append(diff.Added, unrdistDiffItem{idx, unrd.Get("title").String()})
+		}
+	}
+	for idx, unrd := range fromIndex {
+		if _, ok := toIndex[idx]; !ok {
+			diff.Removed = append(diff.Removed, unrdistDiffItem{idx, unrd.Get("title").String()})
+		}
+	}
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].Idx < diff.Added[j].Idx })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].Idx < diff.Removed[j].Idx })
+	return diff
+}
+
+// rev 与 against 的差异，against 为空时与当前配置比较
+func diffRevision(rev, against string) (unrdistDiff, error) {
+	from, err := loadRevision(rev)
+	if err != nil {
+		return unrdistDiff{}, err
+	}
+	var to []byte
+	if against == "" {
+		to, err = store.Load()
+	} else {
+		to, err = loadRevision(against)
+	}
+	if err != nil {
+		return unrdistDiff{}, err
+	}
+	return diffUnrdist(from, to), nil
+}
+
+// 校验 uid
+// GET 列出历史版本，带 rev 时返回该版本与当前配置的差异
+// POST 恢复 rev 对应的版本
+func historyHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	if err := checkUid(w, r); err != nil {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusBadRequest, errorBadRequest, err.Error())
+		return
+	}
+	rev := r.Form.Get("rev")
+	ok := newSyncResult(http.StatusOK, "", "")
+
+	switch {
+	case r.Method == http.MethodPost:
+		err = restoreRevision(rev)
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusBadRequest, errorBadRequest, err.Error())
+			return
+		}
+		writeResult(w, http.StatusOK, ok)
+		log.Println("restore config:", rev)
+	case rev != "":
+		var diff unrdistDiff
+		diff, err = diffRevision(rev, "")
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusNotFound, errorNotFound, err.Error())
+			return
+		}
+		writeResult(w, http.StatusOK, struct {
+			syncResult
+			unrdistDiff
+		}{ok, diff})
+	default:
+		var revisions []revision
+		revisions, err = listRevisions()
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusInternalServerError, errorRead, err.Error())
+			return
+		}
+		writeResult(w, http.StatusOK, struct {
+			syncResult
+			Data []revision `json:"data"`
+		}{ok, revisions})
+	}
+}
+
+var historyCmd = &cobra.Command{
+	Use:              "history",
+	Short:            "manage simpread_config.json revisions",
+	PersistentPreRun: preRun,
+}
+
+var historyListCmd = &cobra.Command{
+	Use:                "list",
+	Short:              "list revisions",
+	Args:               cobra.NoArgs,
+	FParseErrWhitelist: pathFlagsWhitelist,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		revisions, err := listRevisions()
+		if err != nil {
+			return err
+		}
+		for _, r := range revisions {
+			fmt.Printf("%s\t%s\t%d\t%d\n", r.Rev, r.Time.Format("2006-01-02 15:04:05"), r.Count, r.Size)
+		}
+		return nil
+	},
+}
+
+var historyDiffCmd = &cobra.Command{
+	Use:                "diff <rev> [<rev>]",
+	Short:              "summarize unrdist changes between a revision and the current config (or another revision)",
+	Args:               cobra.RangeArgs(1, 2),
+	FParseErrWhitelist: pathFlagsWhitelist,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var against string
+		if len(args) == 2 {
+			against = args[1]
+		}
+		diff, err := diffRevision(args[0], against)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		for _, item := range diff.Added {
+			fmt.Fprintf(&buf, "+ %d\t%s\n", item.Idx, item.Title)
+		}
+		for _, item := range diff.Removed {
+			fmt.Fprintf(&buf, "- %d\t%s\n", item.Idx, item.Title)
+		}
+		fmt.Fprintf(&buf, "%d added, %d removed\n", len(diff.Added), len(diff.Removed))
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	},
+}
+
+var historyRestoreCmd = &cobra.Command{
+	Use:                "restore <rev>",
+	Short:              "restore a revision",
+	Args:               cobra.ExactArgs(1),
+	FParseErrWhitelist: pathFlagsWhitelist,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := restoreRevision(args[0])
+		if err != nil {
+			return err
+		}
+		log.Println("restore config:", args[0])
+		return nil
+	},
+}
+
+func init() {
+	historyCmd.AddCommand(historyListCmd, historyDiffCmd, historyRestoreCmd)
+	rootCmd.AddCommand(historyCmd)
+}
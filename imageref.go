@@ -0,0 +1,306 @@
+package main
+
+import (
+	"html"
+	neturl "net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// 文章中的一处图片引用，[start, end) 为 content 中需要替换的链接部分，
+// alt 和 title 等其余部分保持原样
+type imageRef struct {
+	start int
+	end   int
+	raw   string
+	url   string // 解析后的绝对链接或 data URI，无法解析时为空
+}
+
+var (
+	matchFence    = regexp.MustCompile("^ {0,3}(```+|~~~+)")
+	matchRefDef   = regexp.MustCompile(`(?m)^ {0,3}\[((?:[^\]\\]|\\.)+)\]:[ \t]*(<[^>\n]*>|\S+)`)
+	matchImgTag   = regexp.MustCompile(`(?is)<img\b[^>]*>`)
+	matchHTMLAttr = regexp.MustCompile(`(?s)([A-Za-z_:][-A-Za-z0-9_:.]*)\s*=\s*("([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+))`)
+)
+
+// 代码块和行内代码中的内容不做处理
+func codeMask(content string) []bool {
+	mask := make([]bool, len(content))
+	offset := 0
+	var fence string
+	for _, line := range strings.SplitAfter(content, "\n") {
+		trimmed := strings.TrimRight(line, "\r\n")
+		if fence != "" {
+			for i := offset; i < offset+len(line); i++ {
+				mask[i] = true
+			}
+			if strings.HasPrefix(strings.TrimLeft(trimmed, " "), fence) {
+				fence = ""
+			}
+		} else if m := matchFence.FindStringSubmatch(trimmed); m != nil {
+			fence = m[1]
+			for i := offset; i < offset+len(line); i++ {
+				mask[i] = true
+			}
+		}
+		offset += len(line)
+	}
+
+	for i := 0; i < len(content); {
+		if mask[i] || content[i] != '`' {
+			i++
+			continue
+		}
+		n := 0
+		for i+n < len(content) && content[i+n] == '`' {
+			n++
+		}
+		closing := -1
+		for j := i + n; j < len(content) && !mask[j]; {
+			if content[j] != '`' {
+				j++
+				continue
+			}
+			m := 0
+			for j+m < len(content) && content[j+m] == '`' {
+				m++
+			}
+			if m == n {
+				closing = j + m
+				break
+			}
+			j += m
+		}
+		if closing < 0 {
+			i += n
+			continue
+		}
+		for j := i; j < closing; j++ {
+			mask[j] = true
+		}
+		i = closing
+	}
+	return mask
+}
+
+// 找出 content 中的所有图片：Markdown 行内图片 ![alt](url "title")、引用式图片 ![alt][id] 及其定义、
+// HTML 的 <img src>；base 用于解析相对链接
+func findImages(content string, base *neturl.URL) []imageRef {
+	mask := codeMask(content)
+	var refs []imageRef
+	add := func(start, end int, raw string) {
+		refs = append(refs, imageRef{start: start, end: end, raw: raw, url: resolveImageURL(raw, base)})
+	}
+
+	labels := map[string]struct{}{}
+	for i := 0; i+1 < len(content); i++ {
+		if mask[i] || content[i] != '!' || content[i+1] != '[' || (i > 0 && content[i-1] == '\\') {
+			continue
+		}
+		altEnd := matchBracket(content, i+1)
+		if altEnd < 0 {
+			continue
+		}
+		alt := content[i+2 : altEnd]
+		switch {
+		case altEnd+1 < len(content) && content[altEnd+1] == '(':
+			start, end, raw, closeParen := parseLinkDestination(content, altEnd+2)
+			if closeParen < 0 {
+				continue
+			}
+			add(start, end, raw)
+			i = closeParen
+		case altEnd+1 < len(content) && content[altEnd+1] == '[':
+			labelEnd := matchBracket(content, altEnd+1)
+			if labelEnd < 0 {
+				continue
+			}
+			label := content[altEnd+2 : labelEnd]
+			if label == "" {
+				label = alt
+			}
+			labels[normalizeLabel(label)] = struct{}{}
+			i = labelEnd
+		default:
+			labels[normalizeLabel(alt)] = struct{}{}
+			i = altEnd
+		}
+	}
+
+	for _, m := range matchRefDef.FindAllStringSubmatchIndex(content, -1) {
+		if mask[m[0]] {
+			continue
+		}
+		if _, ok := labels[normalizeLabel(content[m[2]:m[3]])]; !ok {
+			continue
+		}
+		start, end := m[4], m[5]
+		if content[start] == '<' {
+			// 单独的 < 或没有闭合的 <... 不是链接，<> 为空链接
+			if end-start <= 2 || content[end-1] != '>' {
+				continue
+			}
+			start, end = start+1, end-1
+		}
+		add(start, end, content[start:end])
+	}
+
+	for _, m := range matchImgTag.FindAllStringIndex(content, -1) {
+		if mask[m[0]] {
+			continue
+		}
+		tag := content[m[0]:m[1]]
+		for _, a := range matchHTMLAttr.FindAllStringSubmatchIndex(tag, -1) {
+			if !strings.EqualFold(tag[a[2]:a[3]], "src") {
+				continue
+			}
+			for g := 6; g <= 10; g += 2 {
+				if a[g] >= 0 {
+					raw := tag[a[g]:a[g+1]]
+					refs = append(refs, imageRef{
+						start: m[0] + a[g],
+						end:   m[0] + a[g+1],
+						raw:   raw,
+						url:   resolveImageURL(html.UnescapeString(raw), base),
+					})
+					break
+				}
+			}
+			break
+		}
+	}
+
+	sort.Slice(refs, func(i, j int) bool { return refs[i].start < refs[j].start })
+	return refs
+}
+
+// open 为 '[' 的位置，返回匹配的 ']' 的位置
+func matchBracket(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		case '\n':
+			if i+1 < len(s) && s[i+1] == '\n' {
+				return -1
+			}
+		}
+	}
+	return -1
+}
+
+// 解析 ( 之后的链接和可选的标题，返回链接的范围和 ) 的位置
+func parseLinkDestination(s string, i int) (int, int, string, int) {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n') {
+		i++
+	}
+	var start, end int
+	if i < len(s) && s[i] == '<' {
+		start = i + 1
+		end = strings.IndexAny(s[start:], ">\n")
+		if end < 0 || s[start+end] != '>' {
+			return 0, 0, "", -1
+		}
+		end += start
+		i = end + 1
+	} else {
+		start = i
+		depth := 0
+	loop:
+		for ; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '(':
+				depth++
+			case ')':
+				if depth == 0 {
+					break loop
+				}
+				depth--
+			case ' ', '\t', '\n':
+				break loop
+			}
+		}
+		end = i
+	}
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n') {
+		i++
+	}
+	if i < len(s) && (s[i] == '"' || s[i] == '\'' || s[i] == '(') {
+		closer := s[i]
+		if closer == '(' {
+			closer = ')'
+		}
+		for i++; i < len(s) && s[i] != closer; i++ {
+			if s[i] == '\\' {
+				i++
+			}
+		}
+		i++
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n') {
+			i++
+		}
+	}
+	if i >= len(s) || s[i] != ')' {
+		return 0, 0, "", -1
+	}
+	return start, end, s[start:end], i
+}
+
+func normalizeLabel(label string) string {
+	return strings.ToLower(strings.Join(strings.Fields(label), " "))
+}
+
+// 支持 http(s)、协议相对链接 //、data URI 和相对链接，其余情况返回空
+func resolveImageURL(raw string, base *neturl.URL) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return ""
+	}
+	if strings.HasPrefix(strings.ToLower(raw), "data:") {
+		return raw
+	}
+	u, err := neturl.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	if u.Scheme == "" && base != nil {
+		u = base.ResolveReference(u)
+	} else if u.Scheme == "" && u.Host != "" {
+		u.Scheme = "https"
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	return u.String()
+}
+
+// replace 返回 ref 替换后的链接，返回空字符串时保持原样
+func rewriteImages(content string, refs []imageRef, replace func(ref imageRef) string) string {
+	var b strings.Builder
+	last := 0
+	for _, ref := range refs {
+		if ref.start < last {
+			continue
+		}
+		replacement := replace(ref)
+		if replacement == "" {
+			continue
+		}
+		b.WriteString(content[last:ref.start])
+		b.WriteString(replacement)
+		last = ref.end
+	}
+	b.WriteString(content[last:])
+	return b.String()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	neturl "net/url"
+	"reflect"
+	"testing"
+)
+
+func TestFindImages(t *testing.T) {
+	base, _ := neturl.Parse("https://example.com/post/1")
+	tests := []struct {
+		name    string
+		content string
+		raws    []string
+		urls    []string
+	}{
+		{"inline", "![a](img/a.png)", []string{"img/a.png"}, []string{"https://example.com/post/img/a.png"}},
+		{"inline title", `![a](/a.png "标题")`, []string{"/a.png"}, []string{"https://example.com/a.png"}},
+		{"inline angle brackets", "![a](<a b.png> 'title')", []string{"a b.png"}, []string{"https://example.com/post/a%20b.png"}},
+		{"inline parens", "![a](a_(1).png)", []string{"a_(1).png"}, []string{"https://example.com/post/a_(1).png"}},
+		{"reference", "![a][x]\n\n[x]: https://cdn.test/x.png \"t\"", []string{"https://cdn.test/x.png"}, []string{"https://cdn.test/x.png"}},
+		{"reference angle brackets", "![x]\n\n[X]: <//cdn.test/x.png>", []string{"//cdn.test/x.png"}, []string{"https://cdn.test/x.png"}},
+		{"collapsed reference", "![x][]\n\n[x]: x.png (t)", []string{"x.png"}, []string{"https://example.com/post/x.png"}},
+		{"unused reference", "[x]: x.png", nil, nil},
+		{"lone angle bracket", "![x]\n\n[x]: <", nil, nil},
+		{"empty angle brackets", "![x]\n\n[x]: <>", nil, nil},
+		{"unclosed angle bracket", "![x]\n\n[x]: <x.png", nil, nil},
+		{"html", `<p><img alt="a" src='a.png?x=1&amp;y=2'></p>`, []string{"a.png?x=1&amp;y=2"}, []string{"https://example.com/post/a.png?x=1&y=2"}},
+		{"data uri", "![a](data:image/png;base64,AA==)", []string{"data:image/png;base64,AA=="}, []string{"data:image/png;base64,AA=="}},
+		{"unsupported scheme", "![a](ftp://x/a.png)", []string{"ftp://x/a.png"}, []string{""}},
+		{"code", "`![a](a.png)`\n\n```\n![b](b.png)\n```\n\n    ![c](c.png)", []string{"c.png"}, []string{"https://example.com/post/c.png"}},
+		{"escaped", `\![a](a.png)`, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raws, urls []string
+			for _, ref := range findImages(tt.content, base) {
+				raws = append(raws, ref.raw)
+				urls = append(urls, ref.url)
+				if tt.content[ref.start:ref.end] != ref.raw {
+					t.Errorf("range %d:%d = %q, want %q", ref.start, ref.end, tt.content[ref.start:ref.end], ref.raw)
+				}
+			}
+			if !reflect.DeepEqual(raws, tt.raws) || !reflect.DeepEqual(urls, tt.urls) {
+				t.Errorf("findImages(%q) = %q %q, want %q %q", tt.content, raws, urls, tt.raws, tt.urls)
+			}
+		})
+	}
+}
+
+func TestRewriteImages(t *testing.T) {
+	content := "![a](a.png \"t\") ![b][b] <img src=\"a.png\">\n\n[b]: <b.png>"
+	refs := findImages(content, nil)
+	got := rewriteImages(content, refs, func(ref imageRef) string {
+		if ref.raw == "b.png" {
+			return ""
+		}
+		return "assets/" + ref.raw
+	})
+	want := "![a](assets/a.png \"t\") ![b][b] <img src=\"assets/a.png\">\n\n[b]: <b.png>"
+	if got != want {
+		t.Errorf("rewriteImages = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	imageWorkers int
+	imageRetries int
+	imageTimeout time.Duration
+	imageMaxSize int // MB
+)
+
+var errImageTooLarge = errors.New("图片超过 imageMaxSize")
+
+// 除 408 和 429 外的 4xx 不会重试
+type imageStatusError int
+
+func (e imageStatusError) Error() string {
+	return fmt.Sprintf("http status %d", int(e))
+}
+
+func (e imageStatusError) permanent() bool {
+	return e >= 400 && e < 500 && e != http.StatusRequestTimeout && e != http.StatusTooManyRequests
+}
+
+// status 为 ok 时已保存到 path；failed 时下载失败，保留原始链接；
+// remote 为无法解析的链接（如缺少 base 的相对链接），保持原样
+type imageResult struct {
+	URL    string `json:"url"`
+	Status string `json:"status"`
+	Path   string `json:"path,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type fetchedImage struct {
+	body []byte
+	name string
+}
+
+// 一篇文章中的图片，同一链接只下载一次
+type articleImages struct {
+	refs []imageRef
+	urls []string
+	data map[string]fetchedImage
+	errs map[string]error
+}
+
+// 以 imageWorkers 个并发下载 content 中的图片，全部完成（或失败）后返回，ctx 结束时停止下载；
+// base 为文章的链接，用于解析相对链接，可以为空
+func downloadImages(ctx context.Context, content, base string) *articleImages {
+	var baseURL *neturl.URL
+	if base != "" {
+		if u, err := neturl.Parse(base); err == nil && u.IsAbs() {
+			baseURL = u
+		}
+	}
+	a := &articleImages{
+		refs: findImages(content, baseURL),
+		data: map[string]fetchedImage{},
+		errs: map[string]error{},
+	}
+	seen := map[string]struct{}{}
+	for _, ref := range a.refs {
+		if _, ok := seen[ref.url]; !ok && ref.url != "" {
+			seen[ref.url] = struct{}{}
+			a.urls = append(a.urls, ref.url)
+		}
+	}
+
+	workers := imageWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	pending := make(chan string)
+	for i := 0; i < workers && i < len(a.urls); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for url := range pending {
+				var body []byte
+				var contentType string
+				var err error
+				if strings.HasPrefix(strings.ToLower(url), "data:") {
+					body, contentType, err = decodeDataURI(url)
+				} else {
+					body, contentType, err = fetchImage(ctx, url)
+				}
+				mu.Lock()
+				if err != nil {
+					log.Println("下载图片失败：", shortenURL(url), err)
+					a.errs[url] = err
+				} else {
+					a.data[url] = fetchedImage{body: body, name: assetName(body, contentType, url)}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, url := range a.urls {
+		pending <- url
+	}
+	close(pending)
+	wg.Wait()
+	return a
+}
+
+// data:[<mediatype>][;base64],<data>
+func decodeDataURI(uri string) ([]byte, string, error) {
+	comma := strings.IndexByte(uri, ',')
+	if comma < 0 {
+		return nil, "", errors.New("invalid data uri")
+	}
+	meta, data := uri[len("data:"):comma], uri[comma+1:]
+	contentType := strings.TrimSuffix(meta, ";base64")
+	var body []byte
+	var err error
+	if contentType != meta {
+		body, err = base64.StdEncoding.DecodeString(strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\n' || r == '\r' || r == '\t' {
+				return -1
+			}
+			return r
+		}, data))
+	} else {
+		var unescaped string
+		unescaped, err = neturl.PathUnescape(data)
+		body = []byte(unescaped)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if len(body) == 0 {
+		return nil, "", errors.New("empty data uri")
+	}
+	return body, contentType, nil
+}
+
+// data URI 在结果和日志中只保留开头
+func shortenURL(url string) string {
+	if len(url) > 64 && strings.HasPrefix(strings.ToLower(url), "data:") {
+		return url[:64] + "…"
+	}
+	return url
+}
+
+// 每次尝试的超时为 imageTimeout，失败后最多重试 imageRetries 次，超过大小和 4xx 等错误不重试
+func fetchImage(ctx context.Context, url string) ([]byte, string, error) {
+	var err error
+	for attempt := 0; attempt <= imageRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * 500 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, "", ctx.Err()
+			}
+		}
+		var body []byte
+		var contentType string
+		body, contentType, err = fetchImageOnce(ctx, url)
+		if err == nil {
+			return body, contentType, nil
+		}
+		var status imageStatusError
+		if ctx.Err() != nil || errors.Is(err, errImageTooLarge) || errors.As(err, &status) && status.permanent() {
+			return nil, "", err
+		}
+	}
+	return nil, "", err
+}
+
+func fetchImageOnce(ctx context.Context, url string) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, imageTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, "", imageStatusError(resp.StatusCode)
+	}
+	limit := int64(imageMaxSize) << 20
+	if resp.ContentLength > limit {
+		return nil, "", errImageTooLarge
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(body)) > limit {
+		return nil, "", errImageTooLarge
+	}
+	if len(body) == 0 {
+		return nil, "", errors.New("empty body")
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+var imageExtensions = map[string]string{
+	"image/png":                ".png",
+	"image/jpeg":               ".jpg",
+	"image/gif":                ".gif",
+	"image/webp":               ".webp",
+	"image/svg+xml":            ".svg",
+	"image/bmp":                ".bmp",
+	"image/avif":               ".avif",
+	"image/x-icon":             ".ico",
+	"image/vnd.microsoft.icon": ".ico",
+}
+
+// 优先根据文件内容判断类型，其次是 Content-Type 和链接的扩展名，都无法判断时为 .png
+func imageExtension(body []byte, contentType, url string) string {
+	sniffed := http.DetectContentType(body)
+	if ext, ok := imageExtensions[sniffed]; ok {
+		return ext
+	}
+	if len(body) >= 12 && string(body[4:12]) == "ftypavif" {
+		return ".avif"
+	}
+	head := body
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	if strings.HasPrefix(sniffed, "text/") && bytes.Contains(bytes.ToLower(head), []byte("<svg")) {
+		return ".svg"
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if ext, ok := imageExtensions[mediaType]; ok {
+			return ext
+		}
+	}
+	if u, err := neturl.Parse(url); err == nil {
+		ext := strings.ToLower(path.Ext(u.Path))
+		for _, known := range imageExtensions {
+			if ext == known {
+				return ext
+			}
+		}
+		if ext == ".jpeg" {
+			return ".jpg"
+		}
+	}
+	return ".png"
+}
+
+// 以内容的 sha256 命名，相同的图片只保存一份
+func assetName(body []byte, contentType, url string) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])[:32] + imageExtension(body, contentType, url)
+}
+
+func assetStorePath() string {
+	return filepath.Join(syncPath, "asset-store")
+}
+
+// 相同的图片从 syncPath 下的 asset-store 硬链接到各个导出目录；asset-store 中还没有时先写入导出目录，
+// 再硬链接回 asset-store。不支持硬链接（如跨文件系统）时只保留导出目录中的副本，
+// 因此 asset-store 中的图片总是至少被一个导出目录链接着，pruneAssets 不会误删
+func linkAsset(image fetchedImage, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	src := filepath.Join(assetStorePath(), image.name)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	if err := os.WriteFile(dst, image.body, 0644); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(assetStorePath(), 0755); err != nil {
+		log.Println(err)
+		return nil
+	}
+	// asset-store 中已有（与导出目录不在同一文件系统）或无法硬链接时忽略
+	os.Link(dst, src)
+	return nil
+}
+
+// 删除 asset-store 中已经没有导出目录使用（硬链接数为 1）的图片，names 为空时检查全部图片
+func pruneAssets(names ...string) {
+	if len(names) == 0 {
+		fileInfo, err := os.ReadDir(assetStorePath())
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Println(err)
+			}
+			return
+		}
+		for _, file := range fileInfo {
+			if file.Type().IsRegular() {
+				names = append(names, file.Name())
+			}
+		}
+	}
+	for _, name := range names {
+		path := filepath.Join(assetStorePath(), name)
+		n, err := linkCount(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Println(err)
+			}
+			continue
+		}
+		if n <= 1 {
+			if err := os.Remove(path); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// 删除导出的文件夹，之后清理其中 assets 对应的图片
+func removeBundle(dir string) error {
+	var names []string
+	if assets, err := os.ReadDir(filepath.Join(dir, "assets")); err == nil {
+		for _, asset := range assets {
+			names = append(names, asset.Name())
+		}
+	}
+	err := os.RemoveAll(dir)
+	if len(names) > 0 {
+		pruneAssets(names...)
+	}
+	return err
+}
+
+// 把 content 中下载成功的图片链接替换为 assets 下的路径，alt 和标题保持不变
+// 返回替换后的内容、每张图片的结果和需要放入 assets 的图片
+func (a *articleImages) rewrite(content string) (string, []imageResult, []fetchedImage) {
+	local := map[string]string{}
+	results := make([]imageResult, 0, len(a.urls))
+	var assets []fetchedImage
+	seen := map[string]struct{}{}
+	for _, url := range a.urls {
+		result := imageResult{URL: shortenURL(url)}
+		if image, ok := a.data[url]; ok {
+			name := "assets/" + image.name
+			if _, ok := seen[image.name]; !ok {
+				seen[image.name] = struct{}{}
+				assets = append(assets, image)
+			}
+			local[url] = name
+			result.Status = "ok"
+			result.Path = name
+		} else {
+			result.Status = "failed"
+			if err := a.errs[url]; err != nil {
+				result.Error = err.Error()
+			}
+		}
+		results = append(results, result)
+	}
+	for _, ref := range a.refs {
+		if ref.url == "" {
+			results = append(results, imageResult{URL: shortenURL(ref.raw), Status: "remote"})
+		}
+	}
+	content = rewriteImages(content, a.refs, func(ref imageRef) string {
+		return local[ref.url]
+	})
+	return content, results, assets
+}
+
+// 将下载成功的图片写入 dir/assets，并返回替换链接后的内容
+func (a *articleImages) localize(content, dir string) (string, []imageResult, error) {
+	err := os.MkdirAll(filepath.Join(dir, "assets"), 0755)
+	if err != nil {
+		return content, nil, err
+	}
+	content, results, assets := a.rewrite(content)
+	for _, image := range assets {
+		err := linkAsset(image, filepath.Join(dir, "assets", image.name))
+		if err != nil {
+			return content, nil, err
+		}
+	}
+	return content, results, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchImage(t *testing.T) {
+	imageRetries, imageTimeout, imageMaxSize = 2, 5*time.Second, 1
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/busy":
+			if n == 1 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte("GIF89a"))
+		case "/large":
+			w.Write([]byte(strings.Repeat("x", 1<<20+1)))
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path     string
+		err      bool
+		requests int32
+	}{
+		{"/missing", true, 1},
+		{"/busy", false, 2},
+		{"/large", true, 1},
+	}
+	for _, tt := range tests {
+		requests.Store(0)
+		_, _, err := fetchImage(context.Background(), server.URL+tt.path)
+		if (err != nil) != tt.err || requests.Load() != tt.requests {
+			t.Errorf("fetchImage(%s) = %v after %d requests, want error %v after %d", tt.path, err, requests.Load(), tt.err, tt.requests)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := fetchImage(ctx, server.URL+"/busy"); !errors.Is(err, context.Canceled) {
+		t.Errorf("fetchImage with canceled context = %v", err)
+	}
+}
+
+func TestPruneAssets(t *testing.T) {
+	defer func(path string) { syncPath = path }(syncPath)
+	syncPath = t.TempDir()
+	image := fetchedImage{body: []byte("GIF89a"), name: assetName([]byte("GIF89a"), "", "")}
+	var bundles []string
+	for _, name := range []string{"a", "b"} {
+		dir := filepath.Join(syncPath, name)
+		if err := os.MkdirAll(filepath.Join(dir, "assets"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := linkAsset(image, filepath.Join(dir, "assets", image.name)); err != nil {
+			t.Fatal(err)
+		}
+		bundles = append(bundles, dir)
+	}
+	stored := filepath.Join(assetStorePath(), image.name)
+
+	pruneAssets()
+	if _, err := os.Stat(stored); err != nil {
+		t.Fatalf("asset still linked was pruned: %v", err)
+	}
+	if err := removeBundle(bundles[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stored); err != nil {
+		t.Fatalf("asset still linked by b was pruned: %v", err)
+	}
+	if err := removeBundle(bundles[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stored); !os.IsNotExist(err) {
+		t.Errorf("unused asset was not pruned: %v", err)
+	}
+}
+
+// 无法硬链接到 asset-store 时只写入导出目录
+func TestLinkAssetWithoutStore(t *testing.T) {
+	defer func(path string) { syncPath = path }(syncPath)
+	syncPath = t.TempDir()
+	if err := os.WriteFile(assetStorePath(), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	image := fetchedImage{body: []byte("GIF89a"), name: assetName([]byte("GIF89a"), "", "")}
+	dst := filepath.Join(t.TempDir(), image.name)
+	if err := linkAsset(image, dst); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(dst); err != nil || string(data) != "GIF89a" {
+		t.Errorf("asset = %q, %v", data, err)
+	}
+	if n, err := linkCount(dst); err != nil || n != 1 {
+		t.Errorf("asset has %d links, %v", n, err)
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	jobWorkers int
+	jobTimeout time.Duration
+)
+
+// 已结束的任务保留的时间，启动时清理
+const jobRetention = 7 * 24 * time.Hour
+
+// 单个任务日志的最大长度，超出的部分丢弃
+const jobLogLimit = 1 << 20
+
+// 转换任务，状态保存在 syncPath/jobs/{id}.json，
+// 提交的参数保存在 {id}.form 中，任务结束后删除；命令行工具的输出写入 {id}.log
+type job struct {
+	ID       string         `json:"id"`
+	Type     string         `json:"type"`
+	Title    string         `json:"title"`
+	Status   string         `json:"status"`            // queued、running、succeeded、failed、canceled
+	Error    string         `json:"error,omitempty"`   // 与 syncResult 的 error 相同
+	Message  string         `json:"message,omitempty"` // 失败的原因
+	Outputs  []outputResult `json:"outputs,omitempty"`
+	Created  time.Time      `json:"created"`
+	Started  *time.Time     `json:"started,omitempty"`
+	Finished *time.Time     `json:"finished,omitempty"`
+
+	run     jobFunc
+	timeout time.Duration
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// logs 接收命令行工具的输出
+type jobFunc func(ctx context.Context, logs io.Writer) ([]outputResult, error)
+
+// 根据提交的参数检查并生成任务，服务重启后也用它恢复排队中的任务
+var jobTypes = map[string]func(form url.Values) (jobFunc, error){
+	"convert":     prepareConvert,
+	"wkhtmltopdf": prepareWkhtmltopdf,
+}
+
+// 提交的参数有误，code 为返回的状态码，typ 为错误类型
+type requestError struct {
+	code int
+	typ  string
+	err  error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+var errJobNotFound = errors.New("没有找到对应的任务")
+
+var errJobTimeout = errors.New("任务超时")
+
+type jobQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	dir     string
+	jobs    map[string]*job
+	pending []*job
+	closed  bool
+}
+
+var queue *jobQueue
+
+// 读取 dir 中保存的任务：排队中的重新排队，运行中的说明服务曾意外退出，标记为失败
+func openJobQueue(dir string) *jobQueue {
+	q := &jobQueue{dir: dir, jobs: map[string]*job{}}
+	q.cond = sync.NewCond(&q.mu)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Println(err)
+		return q
+	}
+	fileInfo, err := os.ReadDir(dir)
+	if err != nil {
+		log.Println(err)
+		return q
+	}
+	for _, file := range fileInfo {
+		id := strings.TrimSuffix(file.Name(), ".json")
+		if file.IsDir() || id == file.Name() || strings.HasPrefix(id, ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		j := &job{done: make(chan struct{})}
+		if err := json.Unmarshal(data, j); err != nil || j.ID != id {
+			log.Println("任务状态有误：", file.Name())
+			continue
+		}
+		if j.Finished != nil && time.Since(*j.Finished) > jobRetention {
+			q.remove(j)
+			continue
+		}
+		switch j.Status {
+		case "queued":
+			err = q.restore(j)
+		case "running":
+			err = errors.New("服务中断，任务未完成")
+		default:
+			close(j.done)
+		}
+		q.jobs[j.ID] = j
+		if err != nil {
+			q.finish(j, nil, err)
+		}
+	}
+	sort.Slice(q.pending, func(i, k int) bool {
+		return q.pending[i].Created.Before(q.pending[k].Created)
+	})
+	return q
+}
+
+func (q *jobQueue) restore(j *job) error {
+	data, err := os.ReadFile(filepath.Join(q.dir, j.ID+".form"))
+	if err != nil {
+		return err
+	}
+	form, err := url.ParseQuery(string(data))
+	if err != nil {
+		return err
+	}
+	prepare, ok := jobTypes[j.Type]
+	if !ok {
+		return fmt.Errorf("未知的任务类型：%s", j.Type)
+	}
+	j.run, err = prepare(form)
+	if err != nil {
+		return err
+	}
+	j.timeout, err = parseJobTimeout(form)
+	if err != nil {
+		return err
+	}
+	q.pending = append(q.pending, j)
+	return nil
+}
+
+// 提交的 timeout（如 30s、5m，只有数字时为秒）为单个任务的超时时间，不能超过 jobTimeout；
+// 未指定时使用 jobTimeout，为 0 时不限制
+func parseJobTimeout(form url.Values) (time.Duration, error) {
+	v := form.Get("timeout")
+	if v == "" {
+		return jobTimeout, nil
+	}
+	timeout, err := time.ParseDuration(v)
+	if n, e := strconv.Atoi(v); e == nil {
+		timeout, err = time.Duration(n)*time.Second, nil
+	}
+	if err != nil || timeout <= 0 {
+		return 0, &requestError{http.StatusBadRequest, errorBadRequest, fmt.Errorf("timeout 有误：%q", v)}
+	}
+	if jobTimeout > 0 && timeout > jobTimeout {
+		timeout = jobTimeout
+	}
+	return timeout, nil
+}
+
+// 启动 jobWorkers 个 worker，Close 后不再开始新的任务
+func (q *jobQueue) Start() {
+	for i := 0; i < jobWorkers; i++ {
+		go q.work()
+	}
+}
+
+func (q *jobQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+func (q *jobQueue) work() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+		j := q.pending[0]
+		q.pending = q.pending[1:]
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if j.timeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), j.timeout)
+		} else {
+			ctx, cancel = context.WithCancel(context.Background())
+		}
+		now := time.Now()
+		j.Status = "running"
+		j.Started = &now
+		j.cancel = cancel
+		q.save(j)
+		// 关闭时等待运行中的任务
+		jobs.Add(1)
+		q.mu.Unlock()
+
+		q.execute(ctx, j)
+		cancel()
+		jobs.Done()
+	}
+}
+
+func (q *jobQueue) execute(ctx context.Context, j *job) {
+	logs, err := os.OpenFile(filepath.Join(q.dir, j.ID+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Println(err)
+		q.mu.Lock()
+		q.finish(j, nil, err)
+		q.mu.Unlock()
+		return
+	}
+	defer logs.Close()
+
+	outputs, err := q.run(ctx, j, &limitedWriter{w: logs, n: jobLogLimit})
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%w（%s）", errJobTimeout, j.timeout)
+	} else if errors.Is(ctx.Err(), context.Canceled) {
+		err = context.Canceled
+	}
+	if err != nil {
+		fmt.Fprintln(logs, err)
+	}
+	q.mu.Lock()
+	q.finish(j, outputs, err)
+	q.mu.Unlock()
+}
+
+// 转换过程中的 panic 只让当前任务失败，不影响其他任务
+func (q *jobQueue) run(ctx context.Context, j *job, logs io.Writer) (outputs []outputResult, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("任务 %s 出错：%v\n%s", j.ID, v, debug.Stack())
+			outputs, err = nil, fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return j.run(ctx, logs)
+}
+
+// 调用时需持有 q.mu，任一导出失败时任务也视为失败
+func (q *jobQueue) finish(j *job, outputs []outputResult, err error) {
+	now := time.Now()
+	j.Status = "succeeded"
+	j.Outputs = outputs
+	j.Finished = &now
+	j.run = nil
+	j.cancel = nil
+	switch {
+	case errors.Is(err, context.Canceled):
+		j.Status = "canceled"
+		j.Error = errorCanceled
+	case errors.Is(err, errJobTimeout):
+		j.Status = "failed"
+		j.Error = errorTimeout
+		j.Message = err.Error()
+	case err != nil:
+		j.Status = "failed"
+		j.Error = errorConvert
+		j.Message = err.Error()
+	default:
+		if result := outputsResult(outputs); result.Error != "" {
+			j.Status = "failed"
+			j.Error = result.Error
+			j.Message = result.Message
+		}
+	}
+	if j.Status == "failed" {
+		log.Println("任务失败：", j.ID, j.Title, j.Message)
+	}
+	q.save(j)
+	os.Remove(filepath.Join(q.dir, j.ID+".form"))
+	close(j.done)
+}
+
+// 调用时需持有 q.mu
+func (q *jobQueue) save(j *job) {
+	data, err := json.Marshal(j)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = writeFileAtomic(filepath.Join(q.dir, j.ID+".json"), data, 0644)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (q *jobQueue) remove(j *job) {
+	for _, ext := range []string{".json", ".form", ".log"} {
+		err := os.Remove(filepath.Join(q.dir, j.ID+ext))
+		if err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+}
+
+// 检查参数并排队，参数会先写入磁盘以便重启后恢复
+func (q *jobQueue) Add(typ string, form url.Values) (*job, error) {
+	prepare, ok := jobTypes[typ]
+	if !ok {
+		return nil, &requestError{http.StatusBadRequest, errorBadRequest, fmt.Errorf("未知的任务类型：%s", typ)}
+	}
+	run, err := prepare(form)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := parseJobTimeout(form)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	j := &job{
+		ID:      id,
+		Type:    typ,
+		Title:   form.Get("title"),
+		Status:  "queued",
+		Created: time.Now(),
+		run:     run,
+		timeout: timeout,
+		done:    make(chan struct{}),
+	}
+	err = writeFileAtomic(filepath.Join(q.dir, id+".form"), []byte(form.Encode()), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs[id] = j
+	q.save(j)
+	q.pending = append(q.pending, j)
+	q.cond.Signal()
+	return j, nil
+}
+
+// 返回任务的副本，避免序列化时与 worker 同时读写
+func (q *jobQueue) Get(id string) (job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return job{}, fmt.Errorf("%w: %s", errJobNotFound, id)
+	}
+	return *j, nil
+}
+
+// 按提交时间从新到旧排列
+func (q *jobQueue) List() []job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list := make([]job, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		list = append(list, *j)
+	}
+	sort.Slice(list, func(i, k int) bool {
+		return list[i].Created.After(list[k].Created)
+	})
+	return list
+}
+
+// 排队中的任务直接取消，运行中的任务会结束对应的进程，已结束的任务不受影响
+func (q *jobQueue) Cancel(id string) (job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return job{}, fmt.Errorf("%w: %s", errJobNotFound, id)
+	}
+	switch j.Status {
+	case "queued":
+		for i, p := range q.pending {
+			if p == j {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				break
+			}
+		}
+		q.finish(j, nil, context.Canceled)
+	case "running":
+		j.cancel()
+	}
+	return *j, nil
+}
+
+// 等待任务结束，ctx 结束时任务仍在后台继续运行
+func (q *jobQueue) Wait(ctx context.Context, id string) (job, error) {
+	q.mu.Lock()
+	j, ok := q.jobs[id]
+	q.mu.Unlock()
+	if !ok {
+		return job{}, fmt.Errorf("%w: %s", errJobNotFound, id)
+	}
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+	}
+	return q.Get(id)
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(b), nil
+}
+
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+// 超出长度的部分直接丢弃，不向命令行工具返回错误
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.n <= 0 {
+		return len(p), nil
+	}
+	b := p
+	if len(b) > l.n {
+		b = b[:l.n]
+	}
+	n, err := l.w.Write(b)
+	l.n -= n
+	if err != nil {
+		return n, err
+	}
+	return len(p), nil
+}
+
+// 任务对应的返回：成功为 200，未结束为 202，取消为 409，超时为 504，部分导出失败为 207，其余失败为 500
+func jobResult(j job) syncResult {
+	result := newSyncResult(http.StatusOK, j.Error, j.Message)
+	result.Outputs = j.Outputs
+	switch {
+	case j.Status == "queued" || j.Status == "running":
+		result.Status = http.StatusAccepted
+	case j.Status == "canceled":
+		result.Status = http.StatusConflict
+	case j.Error == errorTimeout:
+		result.Status = http.StatusGatewayTimeout
+	case j.Error == errorPartial:
+		result.Status = http.StatusMultiStatus
+	case j.Status == "failed":
+		result.Status = http.StatusInternalServerError
+	}
+	result.Code = result.Status
+	return result
+}
+
+// 提交任务，async 为 true 时立即返回 202 和任务 id，否则等待任务结束后返回结果
+func submitJob(w http.ResponseWriter, r *http.Request, typ string) {
+	j, err := queue.Add(typ, r.Form)
+	if err != nil {
+		log.Println(err)
+		var re *requestError
+		if errors.As(err, &re) {
+			writeError(w, re.code, re.typ, err.Error())
+		} else {
+			writeError(w, http.StatusInternalServerError, errorInternal, err.Error())
+		}
+		return
+	}
+	result := *j
+	if async, _ := strconv.ParseBool(r.Form.Get("async")); !async {
+		result, err = queue.Wait(r.Context(), j.ID)
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusInternalServerError, errorInternal, err.Error())
+			return
+		}
+	}
+
+	status := jobResult(result)
+	writeResult(w, status.Status, struct {
+		syncResult
+		Job string `json:"job"`
+	}{syncResult: status, Job: result.ID})
+}
+
+// /jobs                 GET 列出任务，POST 提交任务（type 为 convert 或 wkhtmltopdf，其余参数与对应接口相同）
+// /jobs/{id}            GET 获取任务状态
+// /jobs/{id}/log        GET 获取命令行工具的输出
+// /jobs/{id}/cancel     POST 取消任务
+func jobsHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	if err := checkUid(w, r); err != nil {
+		return
+	}
+	id, action, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/jobs"), "/"), "/")
+
+	var data interface{}
+	var err error
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		err = r.ParseForm()
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusBadRequest, errorBadRequest, err.Error())
+			return
+		}
+		r.Form.Set("async", "true")
+		submitJob(w, r, r.Form.Get("type"))
+		return
+	case id == "" && r.Method == http.MethodGet:
+		data = queue.List()
+	case action == "" && r.Method == http.MethodGet:
+		data, err = queue.Get(id)
+	case action == "log" && r.Method == http.MethodGet:
+		_, err = queue.Get(id)
+		if err == nil {
+			w.Header().Set("content-type", "text/plain; charset=utf-8")
+			http.ServeFile(w, r, filepath.Join(queue.dir, id+".log"))
+			return
+		}
+	case action == "cancel" && r.Method == http.MethodPost:
+		data, err = queue.Cancel(id)
+		if err == nil {
+			log.Println("cancel job:", id)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errorMethod, r.Method+" "+r.URL.Path)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusNotFound, errorNotFound, err.Error())
+		return
+	}
+
+	writeResult(w, http.StatusOK, struct {
+		syncResult
+		Data interface{} `json:"data"`
+	}{syncResult: newSyncResult(http.StatusOK, "", ""), Data: data})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 注册测试用的任务类型，form 中的 action 决定任务的行为
+func testJobType(t *testing.T) {
+	jobTypes["test"] = func(form url.Values) (jobFunc, error) {
+		action := form.Get("action")
+		if action == "invalid" {
+			return nil, errors.New("invalid")
+		}
+		return func(ctx context.Context, logs io.Writer) ([]outputResult, error) {
+			switch action {
+			case "panic":
+				var m map[string]int
+				m["x"]++
+			case "wait":
+				<-ctx.Done()
+				return nil, ctx.Err()
+			case "fail":
+				return []outputResult{{Path: "a", Status: "failed", Error: "disk full"}}, nil
+			}
+			return []outputResult{{Path: "a", Status: "created"}}, nil
+		}, nil
+	}
+	t.Cleanup(func() { delete(jobTypes, "test") })
+}
+
+func addTestJob(t *testing.T, q *jobQueue, action string) *job {
+	t.Helper()
+	j, err := q.Add("test", url.Values{"action": {action}, "title": {action}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func waitTestJob(t *testing.T, q *jobQueue, id string) job {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	j, err := q.Wait(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("job %s is still %s", id, j.Status)
+	}
+	return j
+}
+
+func TestJobQueue(t *testing.T) {
+	testJobType(t)
+	jobWorkers, jobTimeout = 1, 200*time.Millisecond
+	q := openJobQueue(t.TempDir())
+	q.Start()
+	defer q.Close()
+
+	if _, err := q.Add("test", url.Values{"action": {"invalid"}}); err == nil {
+		t.Error("Add with invalid form succeeded")
+	}
+
+	tests := []struct {
+		action string
+		status string
+		error  string
+	}{
+		{"ok", "succeeded", ""},
+		{"panic", "failed", errorConvert},
+		{"fail", "failed", errorWrite},
+		{"wait", "failed", errorTimeout},
+		{"ok", "succeeded", ""}, // panic 之后 worker 仍在运行
+	}
+	for _, tt := range tests {
+		j := waitTestJob(t, q, addTestJob(t, q, tt.action).ID)
+		if j.Status != tt.status || j.Error != tt.error {
+			t.Errorf("%s: status %s %s, want %s %s", tt.action, j.Status, j.Error, tt.status, tt.error)
+		}
+		if j.Finished == nil {
+			t.Errorf("%s: finished time not set", tt.action)
+		}
+		if _, err := os.Stat(filepath.Join(q.dir, j.ID+".form")); !os.IsNotExist(err) {
+			t.Errorf("%s: form not removed: %v", tt.action, err)
+		}
+	}
+
+	// 唯一的 worker 被占用时，后提交的任务保持排队
+	jobTimeout = 0
+	running := addTestJob(t, q, "wait")
+	queued := addTestJob(t, q, "ok")
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if j, _ := q.Get(running.ID); j.Status == "running" {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("job is still %s", j.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if j, _ := q.Cancel(queued.ID); j.Status != "canceled" {
+		t.Errorf("canceled queued job is %s", j.Status)
+	}
+	q.Cancel(running.ID)
+	if j := waitTestJob(t, q, running.ID); j.Status != "canceled" || j.Error != errorCanceled {
+		t.Errorf("canceled running job is %s %s", j.Status, j.Error)
+	}
+	if _, err := q.Cancel("missing"); !errors.Is(err, errJobNotFound) {
+		t.Errorf("Cancel(missing) = %v", err)
+	}
+}
+
+// 重启后排队中的任务继续运行，运行中的任务标记为失败
+func TestJobQueueRestore(t *testing.T) {
+	testJobType(t)
+	jobWorkers, jobTimeout = 1, 0
+	dir := t.TempDir()
+	q := openJobQueue(dir)
+	queued := addTestJob(t, q, "ok")
+	running := addTestJob(t, q, "ok")
+	q.mu.Lock()
+	running.Status = "running"
+	q.save(running)
+	q.mu.Unlock()
+
+	q = openJobQueue(dir)
+	q.Start()
+	defer q.Close()
+	if j := waitTestJob(t, q, queued.ID); j.Status != "succeeded" {
+		t.Errorf("restored queued job is %s %s", j.Status, j.Message)
+	}
+	if j := waitTestJob(t, q, running.ID); j.Status != "failed" {
+		t.Errorf("restored running job is %s", j.Status)
+	}
+}
+
+func TestParseJobTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { jobTimeout = timeout }(jobTimeout)
+	tests := []struct {
+		global time.Duration
+		value  string
+		want   time.Duration
+		err    bool
+	}{
+		{time.Minute, "", time.Minute, false},
+		{time.Minute, "30s", 30 * time.Second, false},
+		{time.Minute, "10", 10 * time.Second, false},
+		{time.Minute, "1h", time.Minute, false},
+		{0, "1h", time.Hour, false},
+		{0, "", 0, false},
+		{time.Minute, "0", 0, true},
+		{time.Minute, "-1s", 0, true},
+		{time.Minute, "soon", 0, true},
+	}
+	for _, tt := range tests {
+		jobTimeout = tt.global
+		got, err := parseJobTimeout(url.Values{"timeout": {tt.value}})
+		if (err != nil) != tt.err || !tt.err && got != tt.want {
+			t.Errorf("parseJobTimeout(%q) with jobTimeout %s = %s, %v", tt.value, tt.global, got, err)
+		}
+	}
+}
+
+// 单个任务的 timeout 在不限制 jobTimeout 时同样生效
+func TestJobTimeout(t *testing.T) {
+	testJobType(t)
+	jobWorkers, jobTimeout = 1, 0
+	q := openJobQueue(t.TempDir())
+	q.Start()
+	defer q.Close()
+	j, err := q.Add("test", url.Values{"action": {"wait"}, "timeout": {"100ms"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j := waitTestJob(t, q, j.ID); j.Status != "failed" || j.Error != errorTimeout {
+		t.Errorf("job with timeout is %s %s", j.Status, j.Error)
+	}
+	if _, err := q.Add("test", url.Values{"timeout": {"soon"}}); err == nil {
+		t.Error("Add with invalid timeout succeeded")
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// 文件的硬链接数，FileInfo 中没有，需要打开文件读取
+func linkCount(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var d syscall.ByHandleFileInformation
+	err = syscall.GetFileInformationByHandle(syscall.Handle(f.Fd()), &d)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(d.NumberOfLinks), nil
+}
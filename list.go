@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /list 的查询条件，各条件之间为“且”的关系
+type listQuery struct {
+	Offset      int
+	Limit       int // 0 表示不限制
+	Sort        string
+	Desc        bool
+	Tags        []string // 需同时包含
+	ExcludeTags []string // 包含任一则排除
+	Domains     []string // 匹配任一，包含子域名
+	Search      string
+	From        time.Time
+	To          time.Time
+}
+
+// 兼容旧的 filter/value 参数：
+// all 默认只取前 20 条，daily 为今天创建的，dr 和 tag 为标签过滤，search 为关键字搜索
+func parseListQuery(form url.Values) (listQuery, error) {
+	q := listQuery{Sort: "idx", Desc: true}
+	var err error
+
+	value := form.Get("value")
+	switch form.Get("filter") {
+	case "", "all":
+		if form.Get("filter") == "all" {
+			q.Limit = 20
+		}
+	case "daily":
+		now := time.Now()
+		q.From = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+		q.To = q.From.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	case "dr":
+		q.Tags = append(q.Tags, "dr")
+	case "tag":
+		q.Tags = append(q.Tags, value)
+	case "search":
+		q.Search = value
+	default:
+		return q, fmt.Errorf("unknown filter: %q", form.Get("filter"))
+	}
+
+	if v := form.Get("offset"); v != "" {
+		if q.Offset, err = strconv.Atoi(v); err != nil || q.Offset < 0 {
+			return q, fmt.Errorf("invalid offset: %q", v)
+		}
+	}
+	if v := form.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit: %q", v)
+		}
+	}
+	if v := form.Get("sort"); v != "" {
+		switch v {
+		case "idx", "create":
+		case "title":
+			q.Desc = false
+		default:
+			return q, fmt.Errorf("invalid sort: %q", v)
+		}
+		q.Sort = v
+	}
+	if v := form.Get("order"); v != "" {
+		switch v {
+		case "asc":
+			q.Desc = false
+		case "desc":
+			q.Desc = true
+		default:
+			return q, fmt.Errorf("invalid order: %q", v)
+		}
+	}
+	for _, v := range form["tags"] {
+		q.Tags = append(q.Tags, splitTags(v)...)
+	}
+	for _, v := range form["excludeTags"] {
+		q.ExcludeTags = append(q.ExcludeTags, splitTags(v)...)
+	}
+	for _, v := range form["domain"] {
+		for _, domain := range splitTags(v) {
+			q.Domains = append(q.Domains, strings.ToLower(domain))
+		}
+	}
+	if v := form.Get("q"); v != "" {
+		q.Search = v
+	}
+	q.Search = strings.ToLower(q.Search)
+	if v := form.Get("from"); v != "" {
+		if q.From, err = parseListDate(v, false); err != nil {
+			return q, err
+		}
+	}
+	if v := form.Get("to"); v != "" {
+		if q.To, err = parseListDate(v, true); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// 支持 2006-01-02 和 RFC 3339，只有日期时 to 取当天结束
+func parseListDate(s string, end bool) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid date: %q", s)
+	}
+	return t, nil
+}
+
+func (q *listQuery) match(u *Unrd) bool {
+	for _, tag := range q.Tags {
+		if !u.HasTag(tag) {
+			return false
+		}
+	}
+	for _, tag := range q.ExcludeTags {
+		if u.HasTag(tag) {
+			return false
+		}
+	}
+	if len(q.Domains) > 0 {
+		host := unrdHost(u)
+		matched := false
+		for _, domain := range q.Domains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if !q.From.IsZero() || !q.To.IsZero() {
+		create, err := u.CreateTime()
+		if err != nil {
+			return false
+		}
+		if !q.From.IsZero() && create.Before(q.From) {
+			return false
+		}
+		if !q.To.IsZero() && create.After(q.To) {
+			return false
+		}
+	}
+	if q.Search != "" &&
+		!strings.Contains(strings.ToLower(u.Title), q.Search) &&
+		!strings.Contains(strings.ToLower(u.Desc), q.Search) &&
+		!strings.Contains(strings.ToLower(u.Note), q.Search) {
+		return false
+	}
+	return true
+}
+
+func unrdHost(u *Unrd) string {
+	parsed, err := url.Parse(u.URL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Hostname())
+}
+
+// 返回当前页的内容和符合条件的总数
+func (q *listQuery) apply(unrdist []*Unrd) ([]*Unrd, int) {
+	matched := []*Unrd{}
+	for _, u := range unrdist {
+		if q.match(u) {
+			matched = append(matched, u)
+		}
+	}
+
+	var less func(a, b *Unrd) bool
+	switch q.Sort {
+	case "create":
+		less = func(a, b *Unrd) bool {
+			ta, _ := a.CreateTime()
+			tb, _ := b.CreateTime()
+			return ta.Before(tb)
+		}
+	case "title":
+		less = func(a, b *Unrd) bool {
+			return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+		}
+	default:
+		less = func(a, b *Unrd) bool {
+			return a.Idx < b.Idx
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if q.Desc {
+			return less(matched[j], matched[i])
+		}
+		return less(matched[i], matched[j])
+	})
+
+	total := len(matched)
+	if q.Offset >= total {
+		return []*Unrd{}, total
+	}
+	matched = matched[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(matched) {
+		matched = matched[:q.Limit]
+	}
+	return matched, total
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListQuery(t *testing.T) {
+	today := time.Now().Format(createLayout)
+	unrdist := []*Unrd{
+		{Idx: 4, Create: today, Title: "Delta", URL: "https://blog.example.com/d", Tags: []string{"go", "dr"}},
+		{Idx: 3, Create: "2022年10月14日 19:59:58", Title: "alpha", URL: "https://example.com/a", Desc: "Golang 笔记", Tags: []string{"go"}},
+		{Idx: 2, Create: "2022年10月13日 08:00:00", Title: "Charlie", URL: "https://notexample.com/c", Note: "todo", Tags: []string{"rust"}},
+		{Idx: 1, Create: "2022年09月01日 12:00:00", Title: "bravo", URL: "https://other.test/b", Tags: []string{}},
+	}
+	tests := []struct {
+		query string
+		idx   []int
+		total int
+	}{
+		{"", []int{4, 3, 2, 1}, 4},
+		{"filter=all&limit=2&offset=1", []int{3, 2}, 4},
+		{"offset=10", []int{}, 4},
+		{"filter=daily", []int{4}, 1},
+		{"filter=dr", []int{4}, 1},
+		{"filter=tag&value=go", []int{4, 3}, 2},
+		{"tags=go,dr", []int{4}, 1},
+		{"tags=go&excludeTags=dr", []int{3}, 1},
+		{"domain=example.com", []int{4, 3}, 2},
+		{"domain=Other.test,notexample.com", []int{2, 1}, 2},
+		{"q=GOLANG", []int{3}, 1},
+		{"filter=search&value=todo", []int{2}, 1},
+		{"from=2022-10-13&to=2022-10-14", []int{3, 2}, 2},
+		{"to=2022-10-13", []int{2, 1}, 2},
+		{"from=2022-10-14T02:00:00Z&sort=create&order=asc", []int{3, 4}, 2},
+		{"sort=title", []int{3, 1, 2, 4}, 4},
+		{"sort=title&order=desc&limit=1", []int{4}, 4},
+		{"sort=idx&order=asc", []int{1, 2, 3, 4}, 4},
+	}
+	for _, tt := range tests {
+		form, _ := url.ParseQuery(tt.query)
+		q, err := parseListQuery(form)
+		if err != nil {
+			t.Errorf("parseListQuery(%q): %v", tt.query, err)
+			continue
+		}
+		data, total := q.apply(unrdist)
+		idx := []int{}
+		for _, u := range data {
+			idx = append(idx, u.Idx)
+		}
+		if !reflect.DeepEqual(idx, tt.idx) || total != tt.total {
+			t.Errorf("%q = %v (%d), want %v (%d)", tt.query, idx, total, tt.idx, tt.total)
+		}
+	}
+
+	for _, query := range []string{"filter=x", "offset=-1", "limit=a", "sort=url", "order=up", "from=yesterday"} {
+		form, _ := url.ParseQuery(query)
+		if _, err := parseListQuery(form); err == nil {
+			t.Errorf("parseListQuery(%q) succeeded", query)
+		}
+	}
+}
+
+func TestAPIlistHandle(t *testing.T) {
+	defer func(s *configStore) { store = s }(store)
+	store = newConfigStore(filepath.Join(t.TempDir(), "simpread_config.json"))
+	for query, code := range map[string]int{"sort=url": http.StatusBadRequest, "": http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		APIlistHandle(w, httptest.NewRequest(http.MethodGet, "/list?"+query, nil))
+		if w.Code != code {
+			t.Errorf("/list?%s = %d %s, want %d", query, w.Code, w.Body, code)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/tls"
 	"encoding/hex"
@@ -9,24 +10,21 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"mime"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
-	"path"
+	"os/signal"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"github.com/tidwall/gjson"
-	"github.com/tidwall/sjson"
-	"gopkg.in/gomail.v2"
 )
 
 var Version string = "(devel)"
@@ -54,13 +52,23 @@ var tr = &http.Transport{
 var client = &http.Client{Transport: tr}
 
 var rootCmd = &cobra.Command{
-	Use: "simpread-sync",
-	PreRun: func(cmd *cobra.Command, args []string) {
-		parseCustomizedFlags(cmd, args)
-		parseCustomizedEnv()
-		initConfig()
-	},
+	Use:    "simpread-sync",
+	PreRun: preRun,
 	Run: func(cmd *cobra.Command, args []string) {
+		logStartupChecks()
+		initSearchIndex()
+		pruneAssets()
+		queue = openJobQueue(filepath.Join(syncPath, "jobs"))
+		outbox = openOutbox(filepath.Join(syncPath, "outbox"))
+		// 在任务开始前清理上次留下的 tmp- 文件
+		cleanTmpFiles()
+		queue.Start()
+		outbox.Start()
+		tlsConfig, err := initTLS()
+		if err != nil {
+			log.Fatal(err)
+		}
+
 		localSync := http.NewServeMux()
 		localSync.HandleFunc("/verify", verifyHandle)
 		localSync.HandleFunc("/config", configHandle)
@@ -72,29 +80,93 @@ var rootCmd = &cobra.Command{
 		localSync.HandleFunc("/proxy", proxyHandle)
 		localSync.HandleFunc("/textbundle", textbundleHandle)
 		localSync.HandleFunc("/notextbundle", notextbundleHandle)
-		go func() {
-			err := http.ListenAndServe(fmt.Sprint(":", port), localSync)
+		localSync.HandleFunc("/history", historyHandle)
+		localSync.HandleFunc("/jobs", jobsHandle)
+		localSync.HandleFunc("/jobs/", jobsHandle)
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		errs := make(chan error, 2)
+		var servers []*http.Server
+		srv, err := startServer("本地同步", listenAddr, port, tlsConfig, localSync, errs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		servers = append(servers, srv)
+
+		API := http.NewServeMux()
+		API.HandleFunc("/add", requireToken(scopeWrite, APIaddHandle))
+		API.HandleFunc("/adds", requireToken(scopeWrite, APIaddsHandle))
+		API.HandleFunc("/new", requireToken(scopeWrite, APIaddHandle))
+		API.HandleFunc("/webhook", requireToken(scopeWrite, APIaddHandle))
+		API.HandleFunc("/reading/", requireToken(scopeRead, APIreadingHandle))
+		API.HandleFunc("/list", requireToken(scopeRead, APIlistHandle))
+		API.HandleFunc("/entries", requireToken(scopeByMethod, APIentriesHandle))
+		API.HandleFunc("/entries/", requireToken(scopeByMethod, APIentriesHandle))
+		API.HandleFunc("/search", requireToken(scopeRead, APIsearchHandle))
+		API.HandleFunc("/outbox", requireToken(scopeByMethod, APIoutboxHandle))
+		API.HandleFunc("/outbox/", requireToken(scopeByMethod, APIoutboxHandle))
+		if !disableAPI {
+			if len(apiTokens) == 0 {
+				log.Println("未配置 apiTokens，API 只允许本机访问；从其他机器或经过反向代理访问 API 需要配置 apiTokens")
+			}
+			srv, err := startServer("API", apiListenAddr, apiPort, tlsConfig, API, errs)
 			if err != nil {
 				log.Fatal(err)
 			}
-		}()
+			servers = append(servers, srv)
+		}
 
-		API := http.NewServeMux()
-		API.HandleFunc("/add", APIaddHandle)
-		API.HandleFunc("/adds", APIaddsHandle)
-		API.HandleFunc("/new", APIaddHandle)
-		API.HandleFunc("/webhook", APIaddHandle)
-		API.HandleFunc("/reading/", APIreadingHandle)
-		API.HandleFunc("/list", APIlistHandle)
-		err := http.ListenAndServe(fmt.Sprint(":", 7027), API)
-		if err != nil {
+		select {
+		case err := <-errs:
 			log.Fatal(err)
+		case <-ctx.Done():
+			stop()
+			shutdown(servers)
 		}
 	},
+	Args:               cobra.ArbitraryArgs,
 	DisableFlagParsing: true,
 }
 
-func parseCustomizedFlags(cmd *cobra.Command, args []string) {
+// 所有命令共用的 PreRun：读取 --{ext}-path 参数、OUTPUT_PATH_{EXT} 环境变量和配置文件，
+// 保证子命令与服务看到的 enhancedOutput 相同
+func preRun(cmd *cobra.Command, args []string) {
+	if cmd.DisableFlagParsing {
+		parseCustomizedFlags(cmd, args)
+	} else {
+		// 子命令的参数已由 cobra 解析，--{ext}-path 作为未知参数被跳过，从原始参数中读取，
+		// 其余的未知参数仍然报错
+		for _, arg := range parsePathFlags(os.Args[1:]) {
+			if arg == "--" {
+				break
+			}
+			var flag *pflag.Flag
+			if name := strings.TrimPrefix(arg, "--"); name != arg {
+				flag = cmd.Flags().Lookup(strings.SplitN(name, "=", 2)[0])
+			} else if len(arg) > 1 && arg[0] == '-' {
+				flag = cmd.Flags().ShorthandLookup(arg[1:2])
+			} else {
+				continue
+			}
+			if flag == nil {
+				fmt.Fprintln(os.Stderr, "Error: unknown flag:", arg)
+				cmd.Usage()
+				os.Exit(1)
+			}
+		}
+	}
+	parseCustomizedEnv()
+	initConfig()
+}
+
+// 子命令不会预先定义 --{ext}-path 参数，跳过未知参数，由 preRun 读取
+var pathFlagsWhitelist = cobra.FParseErrWhitelist{UnknownFlags: true}
+
+// 取出 --{ext}-path 参数加入 enhancedOutput，返回其余的参数
+func parsePathFlags(args []string) []string {
+	args = append([]string{}, args...)
 	for i := 0; i < len(args); i++ {
 		s := args[i]
 		if len(s) > 2 && s[:2] == "--" {
@@ -122,6 +194,11 @@ func parseCustomizedFlags(cmd *cobra.Command, args []string) {
 			}
 		}
 	}
+	return args
+}
+
+func parseCustomizedFlags(cmd *cobra.Command, args []string) {
+	args = parsePathFlags(args)
 	cmd.DisableFlagParsing = false
 	err := cmd.ParseFlags(args)
 	if err != nil {
@@ -156,35 +233,96 @@ func parseCustomizedEnv() {
 }
 
 func init() {
-	rootCmd.Flags().StringVarP(&configFile, "config", "c", "", "config file")
-	rootCmd.Flags().IntVarP(&port, "port", "p", 7026, "port")
-	rootCmd.Flags().StringVar(&syncPath, "sync-path", "", "sync path")
-	rootCmd.Flags().StringVar(&outputPath, "output-path", "", "output path")
-	rootCmd.Flags().BoolVar(&autoRemove, "auto-remove", false, "auto remove")
-	rootCmd.Flags().StringVar(&smtpHost, "smtp-host", "", "smtp host")
-	rootCmd.Flags().IntVar(&smtpPort, "smtp-port", 465, "smtp port")
-	rootCmd.Flags().StringVar(&smtpUsername, "smtp-username", "", "smtp username")
-	rootCmd.Flags().StringVar(&smtpPassword, "smtp-password", "", "smtp password")
-	rootCmd.Flags().StringVar(&mailTitle, "mail-title", "[简悦] - {{title}}", "mail title")
-	rootCmd.Flags().StringVar(&receiverMail, "receiver-mail", "", "receiver mail")
-	rootCmd.Flags().StringVar(&kindleMail, "kindle-mail", "", "kindle mail")
+	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "", "config file")
+	rootCmd.PersistentFlags().IntVarP(&port, "port", "p", 7026, "port")
+	rootCmd.PersistentFlags().StringVar(&listenAddr, "listen", "", "listen address, or unix:/path/to/socket")
+	rootCmd.PersistentFlags().IntVar(&apiPort, "api-port", 7027, "api port")
+	rootCmd.PersistentFlags().StringVar(&apiListenAddr, "api-listen", "", "api listen address, or unix:/path/to/socket")
+	rootCmd.PersistentFlags().BoolVar(&disableAPI, "disable-api", false, "disable api server")
+	rootCmd.PersistentFlags().StringSlice("api-token", nil, "api token, token:read for read-only")
+	rootCmd.PersistentFlags().StringVar(&certFile, "cert-file", "", "tls certificate file")
+	rootCmd.PersistentFlags().StringVar(&keyFile, "key-file", "", "tls key file")
+	rootCmd.PersistentFlags().BoolVar(&selfSigned, "self-signed", false, "generate a self-signed certificate if missing")
+	rootCmd.PersistentFlags().DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "max time to wait for running jobs on shutdown")
+	rootCmd.PersistentFlags().StringVar(&syncPath, "sync-path", "", "sync path")
+	rootCmd.PersistentFlags().StringVar(&outputPath, "output-path", "", "output path")
+	rootCmd.PersistentFlags().BoolVar(&autoRemove, "auto-remove", false, "auto remove")
+	rootCmd.PersistentFlags().StringVar(&smtpHost, "smtp-host", "", "smtp host")
+	rootCmd.PersistentFlags().IntVar(&smtpPort, "smtp-port", 465, "smtp port")
+	rootCmd.PersistentFlags().StringVar(&smtpUsername, "smtp-username", "", "smtp username")
+	rootCmd.PersistentFlags().StringVar(&smtpPassword, "smtp-password", "", "smtp password")
+	rootCmd.PersistentFlags().StringVar(&mailTitle, "mail-title", "[简悦] - {{title}}", "mail title")
+	rootCmd.PersistentFlags().StringVar(&receiverMail, "receiver-mail", "", "receiver mail")
+	rootCmd.PersistentFlags().StringVar(&kindleMail, "kindle-mail", "", "kindle mail")
 	rootCmd.Flags().BoolVarP(&version, "version", "V", false, "check version")
-	rootCmd.Flags().StringVarP(&uid, "uid", "u", "", "user id")
-
-	viper.BindPFlag("port", rootCmd.Flags().Lookup("port"))
-	viper.BindPFlag("syncPath", rootCmd.Flags().Lookup("sync-path"))
-	viper.BindPFlag("outputPath", rootCmd.Flags().Lookup("output-path"))
-	viper.BindPFlag("autoRemove", rootCmd.Flags().Lookup("auto-remove"))
-	viper.BindPFlag("smtpHost", rootCmd.Flags().Lookup("smtp-host"))
-	viper.BindPFlag("smtpPort", rootCmd.Flags().Lookup("smtp-port"))
-	viper.BindPFlag("smtpUsername", rootCmd.Flags().Lookup("smtp-username"))
-	viper.BindPFlag("smtpPassword", rootCmd.Flags().Lookup("smtp-password"))
-	viper.BindPFlag("mailTitle", rootCmd.Flags().Lookup("mail-title"))
-	viper.BindPFlag("receiverMail", rootCmd.Flags().Lookup("receiver-mail"))
-	viper.BindPFlag("kindleMail", rootCmd.Flags().Lookup("kindle-mail"))
-	viper.BindPFlag("uid", rootCmd.Flags().Lookup("uid"))
+	rootCmd.PersistentFlags().StringVarP(&uid, "uid", "u", "", "user id")
+	rootCmd.PersistentFlags().IntVar(&historyLimit, "history-limit", 20, "number of config revisions to keep")
+	rootCmd.PersistentFlags().IntVar(&imageWorkers, "image-workers", 4, "concurrent image downloads per request")
+	rootCmd.PersistentFlags().IntVar(&imageRetries, "image-retries", 2, "retries for each failed image download")
+	rootCmd.PersistentFlags().DurationVar(&imageTimeout, "image-timeout", 30*time.Second, "timeout for each image download")
+	rootCmd.PersistentFlags().StringVar(&onConflict, "on-conflict", "overwrite", "when an output file exists: overwrite, suffix or skip")
+	rootCmd.PersistentFlags().BoolVar(&transliterate, "transliterate", false, "strip diacritics from file names")
+	rootCmd.PersistentFlags().IntVar(&maxNameLength, "max-name-length", 200, "max file name length in bytes")
+	rootCmd.PersistentFlags().StringSliceVar(&wkhtmltopdfBins, "wkhtmltopdf", []string{"wkhtmltopdf"}, "allowed wkhtmltopdf executables, the first is the default")
+	rootCmd.PersistentFlags().DurationVar(&wkhtmltopdfTimeout, "wkhtmltopdf-timeout", 2*time.Minute, "timeout for each wkhtmltopdf run")
+	rootCmd.PersistentFlags().StringVar(&pdfBackend, "pdf-backend", "wkhtmltopdf", "pdf backend: wkhtmltopdf or native")
+	rootCmd.PersistentFlags().StringVar(&fontDir, "font-dir", "", "font directory for the native pdf backend")
+	rootCmd.PersistentFlags().StringVar(&epubBackend, "epub-backend", "auto", "epub backend: auto, pandoc or native")
+	rootCmd.PersistentFlags().IntVar(&jobWorkers, "job-workers", 2, "concurrent conversion jobs")
+	rootCmd.PersistentFlags().DurationVar(&jobTimeout, "job-timeout", 10*time.Minute, "timeout for each conversion job, 0 for none")
+	rootCmd.PersistentFlags().IntVar(&mailRetries, "mail-retries", 5, "retries for each failed mail")
+	rootCmd.PersistentFlags().DurationVar(&mailRetryInterval, "mail-retry-interval", time.Minute, "wait before the first mail retry, doubled each time")
+	rootCmd.PersistentFlags().IntVar(&imageMaxSize, "image-max-size", 20, "maximum size of each downloaded image in MB")
+
+	viper.BindPFlag("port", rootCmd.PersistentFlags().Lookup("port"))
+	viper.BindPFlag("listen", rootCmd.PersistentFlags().Lookup("listen"))
+	viper.BindPFlag("apiPort", rootCmd.PersistentFlags().Lookup("api-port"))
+	viper.BindPFlag("apiListen", rootCmd.PersistentFlags().Lookup("api-listen"))
+	viper.BindPFlag("disableAPI", rootCmd.PersistentFlags().Lookup("disable-api"))
+	viper.BindPFlag("apiTokens", rootCmd.PersistentFlags().Lookup("api-token"))
+	viper.BindPFlag("certFile", rootCmd.PersistentFlags().Lookup("cert-file"))
+	viper.BindPFlag("keyFile", rootCmd.PersistentFlags().Lookup("key-file"))
+	viper.BindPFlag("selfSigned", rootCmd.PersistentFlags().Lookup("self-signed"))
+	viper.BindPFlag("shutdownTimeout", rootCmd.PersistentFlags().Lookup("shutdown-timeout"))
+	viper.BindPFlag("syncPath", rootCmd.PersistentFlags().Lookup("sync-path"))
+	viper.BindPFlag("outputPath", rootCmd.PersistentFlags().Lookup("output-path"))
+	viper.BindPFlag("autoRemove", rootCmd.PersistentFlags().Lookup("auto-remove"))
+	viper.BindPFlag("smtpHost", rootCmd.PersistentFlags().Lookup("smtp-host"))
+	viper.BindPFlag("smtpPort", rootCmd.PersistentFlags().Lookup("smtp-port"))
+	viper.BindPFlag("smtpUsername", rootCmd.PersistentFlags().Lookup("smtp-username"))
+	viper.BindPFlag("smtpPassword", rootCmd.PersistentFlags().Lookup("smtp-password"))
+	viper.BindPFlag("mailTitle", rootCmd.PersistentFlags().Lookup("mail-title"))
+	viper.BindPFlag("receiverMail", rootCmd.PersistentFlags().Lookup("receiver-mail"))
+	viper.BindPFlag("kindleMail", rootCmd.PersistentFlags().Lookup("kindle-mail"))
+	viper.BindPFlag("uid", rootCmd.PersistentFlags().Lookup("uid"))
+	viper.BindPFlag("historyLimit", rootCmd.PersistentFlags().Lookup("history-limit"))
+	viper.BindPFlag("imageWorkers", rootCmd.PersistentFlags().Lookup("image-workers"))
+	viper.BindPFlag("imageRetries", rootCmd.PersistentFlags().Lookup("image-retries"))
+	viper.BindPFlag("imageTimeout", rootCmd.PersistentFlags().Lookup("image-timeout"))
+	viper.BindPFlag("onConflict", rootCmd.PersistentFlags().Lookup("on-conflict"))
+	viper.BindPFlag("transliterate", rootCmd.PersistentFlags().Lookup("transliterate"))
+	viper.BindPFlag("maxNameLength", rootCmd.PersistentFlags().Lookup("max-name-length"))
+	viper.BindPFlag("wkhtmltopdf", rootCmd.PersistentFlags().Lookup("wkhtmltopdf"))
+	viper.BindPFlag("wkhtmltopdfTimeout", rootCmd.PersistentFlags().Lookup("wkhtmltopdf-timeout"))
+	viper.BindPFlag("pdfBackend", rootCmd.PersistentFlags().Lookup("pdf-backend"))
+	viper.BindPFlag("fontDir", rootCmd.PersistentFlags().Lookup("font-dir"))
+	viper.BindPFlag("epubBackend", rootCmd.PersistentFlags().Lookup("epub-backend"))
+	viper.BindPFlag("jobWorkers", rootCmd.PersistentFlags().Lookup("job-workers"))
+	viper.BindPFlag("jobTimeout", rootCmd.PersistentFlags().Lookup("job-timeout"))
+	viper.BindPFlag("mailRetries", rootCmd.PersistentFlags().Lookup("mail-retries"))
+	viper.BindPFlag("mailRetryInterval", rootCmd.PersistentFlags().Lookup("mail-retry-interval"))
+	viper.BindPFlag("imageMaxSize", rootCmd.PersistentFlags().Lookup("image-max-size"))
 
 	viper.BindEnv("port", "LISTEN_PORT")
+	viper.BindEnv("listen", "LISTEN_ADDR")
+	viper.BindEnv("apiPort", "API_PORT")
+	viper.BindEnv("apiListen", "API_LISTEN")
+	viper.BindEnv("disableAPI", "DISABLE_API")
+	viper.BindEnv("apiTokens", "API_TOKENS")
+	viper.BindEnv("certFile", "CERT_FILE")
+	viper.BindEnv("keyFile", "KEY_FILE")
+	viper.BindEnv("selfSigned", "SELF_SIGNED")
+	viper.BindEnv("shutdownTimeout", "SHUTDOWN_TIMEOUT")
 	viper.BindEnv("syncPath", "SYNC_PATH")
 	viper.BindEnv("outputPath", "OUTPUT_PATH")
 	viper.BindEnv("autoRemove", "AUTO_REMOVE")
@@ -196,6 +334,23 @@ func init() {
 	viper.BindEnv("receiverMail", "MAIL_RECEIVER")
 	viper.BindEnv("kindleMail", "MAIL_KINDLE")
 	viper.BindEnv("uid", "UID")
+	viper.BindEnv("historyLimit", "HISTORY_LIMIT")
+	viper.BindEnv("imageWorkers", "IMAGE_WORKERS")
+	viper.BindEnv("imageRetries", "IMAGE_RETRIES")
+	viper.BindEnv("imageTimeout", "IMAGE_TIMEOUT")
+	viper.BindEnv("onConflict", "ON_CONFLICT")
+	viper.BindEnv("transliterate", "TRANSLITERATE")
+	viper.BindEnv("maxNameLength", "MAX_NAME_LENGTH")
+	viper.BindEnv("wkhtmltopdf", "WKHTMLTOPDF")
+	viper.BindEnv("wkhtmltopdfTimeout", "WKHTMLTOPDF_TIMEOUT")
+	viper.BindEnv("pdfBackend", "PDF_BACKEND")
+	viper.BindEnv("fontDir", "FONT_DIR")
+	viper.BindEnv("epubBackend", "EPUB_BACKEND")
+	viper.BindEnv("jobWorkers", "JOB_WORKERS")
+	viper.BindEnv("jobTimeout", "JOB_TIMEOUT")
+	viper.BindEnv("mailRetries", "MAIL_RETRIES")
+	viper.BindEnv("mailRetryInterval", "MAIL_RETRY_INTERVAL")
+	viper.BindEnv("imageMaxSize", "IMAGE_MAX_SIZE")
 }
 
 func checkVersion() {
@@ -245,6 +400,19 @@ func initConfig() {
 	}
 
 	port = viper.GetInt("port")
+	listenAddr = viper.GetString("listen")
+	apiPort = viper.GetInt("apiPort")
+	apiListenAddr = viper.GetString("apiListen")
+	disableAPI = viper.GetBool("disableAPI")
+	var err error
+	apiTokens, err = parseAPITokens(viper.Get("apiTokens"))
+	if err != nil {
+		log.Fatal("apiTokens 配置有误：", err)
+	}
+	certFile = viper.GetString("certFile")
+	keyFile = viper.GetString("keyFile")
+	selfSigned = viper.GetBool("selfSigned")
+	shutdownTimeout = viper.GetDuration("shutdownTimeout")
 	syncPath = viper.GetString("syncPath")
 	outputPath = viper.GetString("outputPath")
 	enhancedOutputInterface := viper.Get("enhancedOutput")
@@ -266,34 +434,94 @@ func initConfig() {
 	receiverMail = viper.GetString("receiverMail")
 	kindleMail = viper.GetString("kindleMail")
 	uid = viper.GetString("uid")
+	historyLimit = viper.GetInt("historyLimit")
+	imageWorkers = viper.GetInt("imageWorkers")
+	imageRetries = viper.GetInt("imageRetries")
+	imageTimeout = viper.GetDuration("imageTimeout")
+	onConflict = viper.GetString("onConflict")
+	transliterate = viper.GetBool("transliterate")
+	maxNameLength = viper.GetInt("maxNameLength")
+	wkhtmltopdfBins = viper.GetStringSlice("wkhtmltopdf")
+	wkhtmltopdfTimeout = viper.GetDuration("wkhtmltopdfTimeout")
+	pdfBackend = viper.GetString("pdfBackend")
+	fontDir = viper.GetString("fontDir")
+	epubBackend = viper.GetString("epubBackend")
+	converters = map[string]converter{}
+	if err := viper.UnmarshalKey("converters", &converters); err != nil {
+		log.Fatal("converters 有误：", err)
+	}
+	jobWorkers = viper.GetInt("jobWorkers")
+	jobTimeout = viper.GetDuration("jobTimeout")
+	mailRetries = viper.GetInt("mailRetries")
+	mailRetryInterval = viper.GetDuration("mailRetryInterval")
+	imageMaxSize = viper.GetInt("imageMaxSize")
 
 	if syncPath == "" {
 		log.Fatal("未读取到 syncPath！")
 	}
+	for _, i := range enhancedOutput {
+		if err := validateNameTemplate(i["template"]); err != nil {
+			log.Fatal("enhancedOutput 中 ", i["extension"], " 的 template 有误：", err)
+		}
+	}
+	if !validPDFBackend(pdfBackend) {
+		log.Fatal("pdfBackend 只能为 wkhtmltopdf 或 native：", pdfBackend)
+	}
+	if !validEPUBBackend(epubBackend) {
+		log.Fatal("epubBackend 只能为 auto、pandoc 或 native：", epubBackend)
+	}
+	for format, c := range converters {
+		if err := c.validate(format); err != nil {
+			log.Fatal("converters 中 ", format, " 的配置有误：", err)
+		}
+	}
+	// 没有 token 时不允许从其他机器访问 API
+	if !disableAPI && len(apiTokens) == 0 {
+		if apiListenAddr == "" {
+			// 以前默认监听所有网卡，从其他机器或 Docker 容器外调用 API 需要配置 apiTokens
+			apiListenAddr = "127.0.0.1"
+		} else if !isLocalAddr(apiListenAddr) {
+			log.Fatal("未配置 apiTokens 时 apiListen 只能为本机地址或 unix socket：", apiListenAddr)
+		}
+	}
+	if jobWorkers < 1 {
+		log.Fatal("jobWorkers 不能小于 1：", jobWorkers)
+	}
+	if mailRetries < 0 || mailRetryInterval <= 0 {
+		log.Fatal("mailRetries 不能小于 0，mailRetryInterval 需大于 0：", mailRetries, " ", mailRetryInterval)
+	}
+	if imageMaxSize < 1 {
+		log.Fatal("imageMaxSize 不能小于 1：", imageMaxSize)
+	}
+	if !validConflictPolicy(onConflict) {
+		log.Fatal("onConflict 只能为 overwrite、suffix 或 skip：", onConflict)
+	}
 	if outputPath == "" {
 		outputPath = filepath.Join(syncPath, "output")
 	}
 	os.MkdirAll(outputPath, 0755)
 
-	config, err := os.ReadFile(filepath.Join(syncPath, "simpread_config.json"))
+	store = newConfigStore(filepath.Join(syncPath, "simpread_config.json"))
+	names = openNameMap(filepath.Join(syncPath, "names.json"))
+	config, err := store.LoadConfig()
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	unrdist = make(map[int]struct{}, len(gjson.GetBytes(config, "unrdist").Array()))
-	for _, unrd := range gjson.GetBytes(config, "unrdist").Array() {
-		unrdist[int(unrd.Get("idx").Int())] = struct{}{}
-	}
+	unrdist = config.IdxSet()
 }
 
 // 本地未存储 uid 返回 {"code": 201}
 // 本地 uid 与 header 中的 uid 一致 json 返回 {"code":403,"status":"same"}
 // 本地 uid 与 header 中的 uid 不一致 json 返回 {"code":403,"status":"uid"}
+// 两者都为空时返回空的 200，插件首次探测时依赖这一行为
+// 浏览器插件依赖以上格式，因此不使用 syncResult
 func verifyHandle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
 	err := r.ParseForm()
 	if err != nil {
 		log.Println(err)
+		writeError(w, http.StatusBadRequest, errorBadRequest, err.Error())
 		return
 	}
 	var result []byte
@@ -323,7 +551,9 @@ func verifyHandle(w http.ResponseWriter, r *http.Request) {
 		}
 	} else if r.Header.Get("uid") != "" {
 		uid = r.Header.Get("uid")
-		viper.WriteConfig()
+		if err := viper.WriteConfig(); err != nil {
+			log.Println(err)
+		}
 		result, err = json.Marshal(struct {
 			Code int `json:"code"`
 		}{
@@ -373,6 +603,13 @@ func getOutputPaths(extension string) []string {
 
 func getOutputPathsWithPath(extension, path string) []string {
 	outputPaths := []string{}
+	for _, target := range getOutputTargets(extension, path) {
+		outputPaths = append(outputPaths, target.Path)
+	}
+	return outputPaths
+}
+func getOutputTargets(extension, path string) []outputTarget {
+	targets := []outputTarget{}
 	for _, i := range enhancedOutput {
 		if extension == i["extension"] {
 			path := i["path"]
@@ -380,13 +617,13 @@ func getOutputPathsWithPath(extension, path string) []string {
 				path = filepath.Join(outputPath, extension)
 			}
 			os.MkdirAll(path, 0755)
-			outputPaths = append(outputPaths, path)
+			targets = append(targets, outputTarget{Path: path, Template: i["template"]})
 		}
 	}
-	if len(outputPaths) == 0 {
-		outputPaths = append(outputPaths, path)
+	if len(targets) == 0 {
+		targets = append(targets, outputTarget{Path: path})
 	}
-	return outputPaths
+	return targets
 }
 
 // 规避标准库大小限制
@@ -407,7 +644,35 @@ func myParseForm(r *http.Request) error {
 }
 
 var etag string
-var unrdist map[int]struct{}
+
+// 只在 store 的写锁内修改
+var unrdist = map[int]struct{}{}
+
+// 删除 outputPath 下属于 idx 的导出文件
+func removeOutputFiles(idx int) {
+	fileInfo, err := os.ReadDir(outputPath)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, file := range fileInfo {
+		if !file.IsDir() && strings.HasPrefix(file.Name(), fmt.Sprint(idx, "-")) {
+			err := os.Remove(filepath.Join(outputPath, file.Name()))
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			index.Remove(filepath.Join(outputPath, file.Name()))
+		}
+	}
+	for _, path := range names.RemoveIdx(idx) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Println(err)
+		}
+		index.Remove(path)
+	}
+}
 
 // 如果浏览器插件的设置项更改了，它会发一个 key 为 config 的请求，json 返回 200
 // 剩余情况下，返回一个 key 为 result 的 json
@@ -419,62 +684,50 @@ func configHandle(w http.ResponseWriter, r *http.Request) {
 		err := myParseForm(r)
 		if err != nil {
 			log.Println(err)
+			writeError(w, http.StatusBadRequest, errorBadRequest, err.Error())
 			return
 		}
 
 		if data := r.Form.Get("config"); data != "" {
-			err := os.WriteFile(filepath.Join(syncPath, "simpread_config.json"), []byte(data), 0644)
+			config, err := parseConfig([]byte(data))
 			if err != nil {
 				log.Println(err)
+				writeError(w, http.StatusBadRequest, errorBadRequest, err.Error())
 				return
 			}
-
-			if autoRemove {
-				newUnrdist := make(map[int]struct{}, len(gjson.Get(data, "unrdist").Array()))
-				for _, unrd := range gjson.Get(data, "unrdist").Array() {
-					newUnrdist[int(unrd.Get("idx").Int())] = struct{}{}
-				}
-				var toDelete int
+			var removed []int
+			err = store.Update(func([]byte) ([]byte, error) {
+				newUnrdist := config.IdxSet()
 				for idx := range unrdist {
 					if _, ok := newUnrdist[idx]; !ok {
-						toDelete = idx
-						break
+						removed = append(removed, idx)
 					}
 				}
 				unrdist = newUnrdist
-				fileInfo, err := os.ReadDir(outputPath)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				for _, file := range fileInfo {
-					if !file.IsDir() && strings.HasPrefix(file.Name(), fmt.Sprint(toDelete, "-")) {
-						err := os.Remove(filepath.Join(outputPath, file.Name()))
-						if err != nil {
-							log.Println(err)
-						}
-					}
-				}
-			}
-
-			result, err := json.Marshal(struct {
-				Status int `json:"status"`
-			}{Status: 200})
+				return []byte(data), nil
+			})
 			if err != nil {
 				log.Println(err)
+				writeError(w, http.StatusInternalServerError, errorWrite, err.Error())
 				return
 			}
 
-			_, err = w.Write(result)
-			if err != nil {
-				log.Println(err)
-				return
+			if autoRemove {
+				for _, idx := range removed {
+					removeOutputFiles(idx)
+				}
 			}
+
+			writeResult(w, http.StatusOK, newSyncResult(http.StatusOK, "", ""))
 			log.Println("sync config from browser")
 		} else {
-			config, err := os.ReadFile(filepath.Join(syncPath, "simpread_config.json"))
-			if err != nil {
+			config, err := store.Load()
+			if os.IsNotExist(err) {
+				writeError(w, http.StatusNotFound, errorNotFound, "没有找到 simpread_config.json")
+				return
+			} else if err != nil {
 				log.Println(err)
+				writeError(w, http.StatusInternalServerError, errorRead, err.Error())
 				return
 			}
 
@@ -487,41 +740,17 @@ func configHandle(w http.ResponseWriter, r *http.Request) {
 
 			w.Header().Set("Etag", etag)
 
-			result, err := json.Marshal(struct {
-				Status int    `json:"status"`
+			writeResult(w, http.StatusOK, struct {
+				syncResult
 				Result string `json:"result"`
 			}{
-				Status: 200,
-				Result: string(config),
+				syncResult: newSyncResult(http.StatusOK, "", ""),
+				Result:     string(config),
 			})
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			_, err = w.Write(result)
-			if err != nil {
-				log.Println(err)
-				return
-			}
 			log.Println("sync config from local")
 		}
 	} else {
-		result, err := json.Marshal(struct {
-			Status string `json:"status"`
-		}{
-			Status: "error",
-		})
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		_, err = w.Write(result)
-		if err != nil {
-			log.Println(err)
-			return
-		}
+		writeError(w, http.StatusInternalServerError, errorInternal, "未配置 syncPath")
 	}
 }
 
@@ -535,42 +764,58 @@ func plainHandle(w http.ResponseWriter, r *http.Request) {
 		err := myParseForm(r)
 		if err != nil {
 			log.Println(err)
+			writeError(w, http.StatusBadRequest, errorBadRequest, err.Error())
 			return
 		}
 
-		title := r.Form.Get("title")
+		title := safeName(r.Form.Get("title"))
 		content := r.Form.Get("content")
 
-		suffix := path.Ext(title)[1:]
+		suffix := strings.TrimPrefix(filepath.Ext(title), ".")
 		if strings.HasPrefix(title, "tmp-") {
 			suffix = "tmp"
 		}
-		for _, path := range getOutputPaths(suffix) {
-			err = os.WriteFile(filepath.Join(path, title), []byte(content), 0644)
-			if err != nil {
-				log.Println(err)
-				continue //TODO 错误处理
+		ext := filepath.Ext(title)
+		fields := newNameFields(title, ext, r.Form.Get("idx"), r.Form.Get("url"), r.Form.Get("tags"))
+		var outputs []outputResult
+		for _, target := range getOutputTargets(suffix, outputPath) {
+			// tmp- 文件只是临时文件，总是覆盖
+			if suffix == "tmp" {
+				output := outputResult{Path: filepath.Join(target.Path, title), Status: "overwritten"}
+				if _, err := os.Lstat(output.Path); os.IsNotExist(err) {
+					output.Status = "created"
+				}
+				err = os.WriteFile(output.Path, []byte(content), 0644)
+				if err != nil {
+					log.Println(err)
+					output.Status = "failed"
+					output.Error = err.Error()
+				}
+				outputs = append(outputs, output)
+				continue
 			}
+			output := writeOutput(target.Path, target.name(fields, title, ext), ext, nil, func(path string) error {
+				return os.WriteFile(path, []byte(content), 0644)
+			})
+			if output.Status != "failed" && output.Status != "skipped" {
+				if target.Template != "" {
+					names.Set(title, output.Path)
+					index.Add(output.Path, title)
+				} else {
+					index.Add(output.Path, filepath.Base(output.Path))
+				}
+			}
+			outputs = append(outputs, output)
 		}
 
-		result, err := json.Marshal(struct {
-			Status int `json:"status"`
-		}{Status: 200})
-		if err != nil {
-			log.Println(err)
-			return
-		}
+		result := outputsResult(outputs)
+		writeResult(w, result.Status, result)
 		log.Println("save file:", title)
-
-		_, err = w.Write(result)
-		if err != nil {
-			log.Println(err)
-			return
-		}
 	}
 }
 
 // 校验 uid
+// 邮件先放入 outbox，等待第一次发送的结果：成功返回 200，之后还会重试时返回 202
 func mailHandle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
 
@@ -580,6 +825,11 @@ func mailHandle(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseForm()
 		if err != nil {
 			log.Println(err)
+			writeError(w, http.StatusBadRequest, errorBadRequest, err.Error())
+			return
+		}
+		if smtpHost == "" {
+			writeError(w, http.StatusServiceUnavailable, errorUnavailable, "未配置 smtpHost")
 			return
 		}
 
@@ -587,50 +837,51 @@ func mailHandle(w http.ResponseWriter, r *http.Request) {
 		content := r.Form.Get("content")
 		attach := r.Form.Get("attach")
 
-		d := gomail.NewDialer(smtpHost, smtpPort, smtpUsername, smtpPassword)
-		d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-		s, err := d.Dial()
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		m := gomail.NewMessage()
-		m.SetHeader("From", smtpUsername)
-		var attachPath string
+		var to, attachPath, attachName string
 		if content == "kindle" {
-			m.SetHeader("To", kindleMail)
-			attachPath = filepath.Join(outputPath, fmt.Sprintf("tmp-%s.%s", title, attach))
-			m.Attach(attachPath, gomail.Rename(mime.QEncoding.Encode("utf-8",
-				fmt.Sprintf("%s.%s", title, attach))))
-			defer os.Remove(attachPath)
+			to = kindleMail
+			attachPath = filepath.Join(outputPath, safeName(fmt.Sprintf("tmp-%s.%s", title, attach)))
+			attachName = fmt.Sprintf("%s.%s", title, attach)
+			if _, err := os.Stat(attachPath); err != nil {
+				log.Println(err)
+				writeError(w, http.StatusNotFound, errorNotFound, "没有找到附件："+filepath.Base(attachPath))
+				return
+			}
 		} else {
 			// 这里偷懒直接替换文本
 			title = strings.ReplaceAll(mailTitle, "{{title}}", title)
-			m.SetHeader("To", receiverMail)
+			to = receiverMail
 		}
-		m.SetHeader("Subject", title)
-		m.SetBody("text/html", content)
 
-		err = gomail.Send(s, m)
+		m, err := outbox.Add(to, title, content, attachPath, attachName)
 		if err != nil {
 			log.Println(err)
+			writeError(w, http.StatusInternalServerError, errorWrite, err.Error())
 			return
 		}
-
-		result, err := json.Marshal(struct {
-			Status int `json:"status"`
-		}{Status: 200})
-		if err != nil {
-			log.Println(err)
-			return
+		select {
+		case <-m.attempted:
+		case <-r.Context().Done():
 		}
-		_, err = w.Write(result)
+		m, err = outbox.Get(m.ID)
 		if err != nil {
 			log.Println(err)
+			writeError(w, http.StatusInternalServerError, errorInternal, err.Error())
 			return
 		}
-		log.Println("send mail:", title)
+
+		result := newSyncResult(http.StatusOK, "", "")
+		switch m.Status {
+		case "sent":
+		case "failed":
+			result = newSyncResult(http.StatusBadGateway, errorMail, m.Error)
+		default:
+			result = newSyncResult(http.StatusAccepted, errorMail, m.Error)
+		}
+		writeResult(w, result.Status, struct {
+			syncResult
+			Mail string `json:"mail"`
+		}{syncResult: result, Mail: m.ID})
 	}
 }
 
@@ -644,102 +895,162 @@ func convertHandle(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseForm()
 		if err != nil {
 			log.Println(err)
+			writeError(w, http.StatusBadRequest, errorBadRequest, err.Error())
 			return
 		}
-		title := r.Form.Get("title")
-		content := r.Form.Get("content")
-		in := r.Form.Get("in")   //md
-		out := r.Form.Get("out") //epub
+		submitJob(w, r, "convert")
+		log.Println("convert file:", r.Form.Get("title"))
+	}
+}
 
-		tmpFilePath := filepath.Join(syncPath, fmt.Sprintf("tmp-%s.%s", title, in))
-		err = os.WriteFile(tmpFilePath, []byte(content), 0644)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		pandoc := "pandoc"
-		if runtime.GOOS == "darwin" {
-			pandoc = "/usr/local/bin/pandoc"
-		}
-		//TODO 并发
-		for _, path := range getOutputPaths(out) {
-			cmd := exec.Command(pandoc, tmpFilePath, "-o", filepath.Join(path, title+"."+out))
-			err = cmd.Run()
+func prepareConvert(form url.Values) (jobFunc, error) {
+	title := form.Get("title")
+	content := form.Get("content")
+	in := form.Get("in")   //md
+	out := form.Get("out") //epub
+	if !matchFormat.MatchString(in) || !matchFormat.MatchString(out) {
+		return nil, &requestError{http.StatusBadRequest, errorBadRequest, fmt.Errorf("格式有误：%q -> %q", in, out)}
+	}
+
+	fields := newNameFields(title, "", form.Get("idx"), form.Get("url"), form.Get("tags"))
+	conv := converters[out]
+	pandoc, pandocErr := conv.pandoc()
+	if out == "epub" && (epubBackend == "native" || epubBackend == "auto" && pandocErr != nil) {
+		author := form.Get("author")
+		if author == "" {
+			author = fields.Domain
+		}
+		meta := epubMeta{
+			Title:    title,
+			Author:   author,
+			Source:   form.Get("url"),
+			Language: form.Get("lang"),
+			Cover:    form.Get("cover"),
+		}
+		return func(ctx context.Context, logs io.Writer) ([]outputResult, error) {
+			epub, images, err := renderNativeEPUB(ctx, content, in, meta)
+			for _, image := range images {
+				if image.Status == "failed" {
+					fmt.Fprintln(logs, "图片下载失败：", image.URL, image.Error)
+				}
+			}
 			if err != nil {
-				log.Println(err)
-				continue //TODO 错误处理
+				return nil, err
 			}
-		}
-
-		os.Remove(tmpFilePath)
-
-		result, err := json.Marshal(struct {
-			Status int `json:"status"`
-		}{Status: 200})
+			return writeOutputFiles(out, fields, title, epub), nil
+		}, nil
+	}
+	if pandocErr != nil {
+		return nil, &requestError{http.StatusNotImplemented, errorUnavailable, pandocErr}
+	}
+	return func(ctx context.Context, logs io.Writer) ([]outputResult, error) {
+		data, err := runPandoc(ctx, pandoc, conv.args(fields), in, out, content, logs)
 		if err != nil {
-			log.Println(err)
-			return
+			return nil, err
 		}
+		return writeOutputFiles(out, fields, title, data), nil
+	}, nil
+}
 
-		_, err = w.Write(result)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		log.Println("convert file:", title)
+// 把同一份结果写入 ext 对应的所有导出目录
+func writeOutputFiles(ext string, fields *nameFields, title string, data []byte) []outputResult {
+	var outputs []outputResult
+	for _, target := range getOutputTargets(ext, outputPath) {
+		name := target.name(fields, title+"."+ext, "."+ext)
+		outputs = append(outputs, writeOutput(target.Path, name, "."+ext, nil, func(path string) error {
+			return writeFileAtomic(path, data, 0644)
+		}))
 	}
+	return outputs
 }
 
-// 不校验 uid
+// 校验 uid
 func wkhtmltopdfHandle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
+
+	if err := checkUid(w, r); err != nil {
+		return
+	}
 	err := r.ParseForm()
 	if err != nil {
 		log.Println(err)
+		writeError(w, http.StatusBadRequest, errorBadRequest, err.Error())
 		return
 	}
-	title := r.Form.Get("title")
-	content := r.Form.Get("content")
-	params := strings.Split(r.Form.Get("params"), " ")
-	root := r.Form.Get("root")
+	submitJob(w, r, "wkhtmltopdf")
+	log.Println("wkhtmltopdf:", r.Form.Get("title"))
+}
+
+func prepareWkhtmltopdf(form url.Values) (jobFunc, error) {
+	title := form.Get("title")
+	content := form.Get("content")
+	fields := newNameFields(title, "", form.Get("idx"), form.Get("url"), form.Get("tags"))
 
-	tmpFilePath := filepath.Join(syncPath, fmt.Sprintf("tmp-%s.html", title))
-	err = os.WriteFile(tmpFilePath, []byte(content), 0644)
+	if pdfBackend == "native" {
+		base := form.Get("url")
+		return func(ctx context.Context, logs io.Writer) ([]outputResult, error) {
+			pdf, err := renderNativePDF(ctx, title, content, base)
+			if err != nil {
+				return nil, err
+			}
+			return writeOutputFiles("pdf", fields, title, pdf), nil
+		}, nil
+	}
+	bin, err := resolveWkhtmltopdf(form.Get("root"))
 	if err != nil {
-		log.Println(err)
-		return
+		return nil, &requestError{http.StatusForbidden, errorForbidden, err}
 	}
-
-	if root == "" {
-		root = "wkhtmltopdf"
+	params, err := parseWkhtmltopdfParams(form.Get("params"))
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, errorBadRequest, err}
 	}
-	// TODO 并发
-	for _, path := range getOutputPaths("pdf") {
-		cmd := exec.Command(root, append(params, tmpFilePath, filepath.Join(path, title+".pdf"))...)
-
-		err = cmd.Run()
+	return func(ctx context.Context, logs io.Writer) ([]outputResult, error) {
+		pdf, err := renderWkhtmltopdf(ctx, bin, params, content, logs)
 		if err != nil {
-			log.Println(err)
-			continue //TODO 错误处理
+			return nil, err
 		}
-	}
+		return writeOutputFiles("pdf", fields, title, pdf), nil
+	}, nil
+}
 
-	os.Remove(tmpFilePath)
+// /reading/ 可以读取的文件，name 为原始文件名，path 为实际路径
+type readingFile struct {
+	name string
+	path string
+}
 
-	result, err := json.Marshal(struct {
-		Status int `json:"status"`
-	}{Status: 200})
+// outputPath 下的文件，以及按模板导出到其他位置、以原始文件名查找的文件
+func readingFiles() ([]readingFile, error) {
+	fileInfo, err := os.ReadDir(outputPath)
 	if err != nil {
-		log.Println(err)
-		return
+		return nil, err
+	}
+	var files []readingFile
+	for _, file := range fileInfo {
+		if !file.IsDir() {
+			files = append(files, readingFile{name: file.Name(), path: filepath.Join(outputPath, file.Name())})
+		}
 	}
+	for _, name := range names.Names() {
+		if path := names.Lookup(name); path != "" {
+			files = append(files, readingFile{name: name, path: path})
+		}
+	}
+	return files, nil
+}
 
-	_, err = w.Write(result)
-	if err != nil {
-		log.Println(err)
-		return
+// 按 idx 或标题查找以 suffix 结尾的文件，批注（@annote）除外
+func findReading(files []readingFile, id, query, suffix string) (readingFile, bool) {
+	for _, file := range files {
+		if (strings.HasPrefix(file.name, id+"-") &&
+			strings.HasSuffix(file.name, suffix) &&
+			!strings.Contains(file.name, "@annote")) ||
+			file.name == id+suffix ||
+			file.name == safeName(query+suffix) {
+			return file, true
+		}
 	}
-	log.Println("wkhtmltopdf:", title)
+	return readingFile{}, false
 }
 
 // 请求压根没带 uid
@@ -747,27 +1058,28 @@ func readingHandle(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		log.Println(err)
+		writeError(w, http.StatusBadRequest, errorBadRequest, err.Error())
 		return
 	}
 
-	var files []string
-	fileInfo, err := os.ReadDir(outputPath)
+	files, err := readingFiles()
 	if err != nil {
 		log.Println(err)
+		writeError(w, http.StatusInternalServerError, errorRead, err.Error())
 		return
 	}
-	for _, file := range fileInfo {
-		if !file.IsDir() {
-			files = append(files, file.Name())
-		}
-	}
 
 	var result []byte
 	if r.RequestURI == "/reading/index" {
 		w.Header().Set("content-type", "application/json")
+		var list []string
+		for _, file := range files {
+			list = append(list, file.name)
+		}
 		result, err = json.Marshal(struct {
+			syncResult
 			Files []string `json:"files"`
-		}{Files: files})
+		}{syncResult: newSyncResult(http.StatusOK, "", ""), Files: list})
 		if err != nil {
 			log.Println(err)
 			return
@@ -775,46 +1087,22 @@ func readingHandle(w http.ResponseWriter, r *http.Request) {
 		log.Println("reading index")
 	} else {
 		id := strings.Replace(r.URL.Path, "/reading/", "", 1)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		query := r.URL.Query().Get("title")
 		suffix := r.Header.Get("type")
 		if suffix == "" {
 			suffix = ".html"
 		}
 
-		var title string
-		for _, file := range files {
-			if (strings.HasPrefix(file, id+"-") &&
-				strings.HasSuffix(file, suffix) &&
-				!strings.Contains(file, "@annote")) ||
-				file == id+suffix ||
-				file == query+suffix {
-				title = file
-				break
-			}
-		}
-
-		if title != "" {
-			result, err = os.ReadFile(filepath.Join(outputPath, title))
+		if file, ok := findReading(files, id, r.URL.Query().Get("title"), suffix); ok {
+			result, err = os.ReadFile(file.path)
 			if err != nil {
 				log.Println(err)
+				writeError(w, http.StatusInternalServerError, errorRead, err.Error())
 				return
 			}
-			log.Println("reading file:", title)
+			log.Println("reading file:", file.name)
 		} else {
-			w.Header().Set("content-type", "application/json")
-			result, err = json.Marshal(struct {
-				Code    int    `json:"code"`
-				Message string `json:"message"`
-			}{Code: 404, Message: "没有找到对应的内容"})
-			if err != nil {
-				log.Println(err)
-				return
-			}
+			writeError(w, http.StatusNotFound, errorNotFound, "没有找到对应的内容")
+			return
 		}
 	}
 
@@ -825,10 +1113,8 @@ func readingHandle(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-var matchImage = regexp.MustCompile(`(?i)\!\[(\S+)?\]\(http(s)?:\/\/[^)]+\)`)
-var matchReplace = regexp.MustCompile(`^!\[(\S+)?\]\(|\)$`)
-
 // 校验 uid
+// 图片下载完成后才写入 text.markdown 并返回每张图片的结果
 func textbundleHandle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
 
@@ -838,84 +1124,60 @@ func textbundleHandle(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseForm()
 		if err != nil {
 			log.Println(err)
+			writeError(w, http.StatusBadRequest, errorBadRequest, err.Error())
 			return
 		}
 		title := r.Form.Get("title")
 		content := r.Form.Get("content")
-		images := matchImage.FindAllString(content, -1)
-		// TODO 提升性能
-		for _, path := range getOutputPaths("textbundle") {
-			filePath := filepath.Join(path, title+".textbundle")
-
-			err = os.Mkdir(filePath, 0755)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			err = os.Mkdir(filepath.Join(filePath, "assets"), 0755)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			for i, image := range images {
-				content = strings.Replace(content, image, fmt.Sprint("![](assets/", i, ".png)"), 1)
-				go func(i int, image string) {
-					image = matchReplace.ReplaceAllString(image, "")
-
-					resp, err := client.Get(image)
-					if err != nil {
-						log.Println(err)
-						return
-					}
-					defer resp.Body.Close()
-
-					body, err := io.ReadAll(resp.Body)
-					if err != nil {
-						log.Println(err)
-						return
-					}
-
-					err = os.WriteFile(filepath.Join(filePath, "assets", fmt.Sprint(i, ".png")), body, 0644)
-					if err != nil {
-						log.Println(err)
-						return
-					}
-				}(i, image)
-			}
-
-			err = os.WriteFile(filepath.Join(filePath, "info.json"), []byte(`{"transient":true,"type":"net.daringfireball.markdown","creatorIdentifier":"pro.simpread","version":2}`), 0644)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			err = os.WriteFile(filepath.Join(filePath, "text.markdown"), []byte(content), 0644)
-			if err != nil {
-				log.Println(err)
-				return
-			}
+		images := downloadImages(r.Context(), content, r.Form.Get("url"))
+		if err := r.Context().Err(); err != nil {
+			log.Println("请求已取消：", title, err)
+			return
 		}
 
-		result, err := json.Marshal(struct {
-			Status int `json:"status"`
-		}{Status: 200})
-		if err != nil {
-			log.Println(err)
-			return
+		// 只配置了 textpack 时不再输出 textbundle
+		var packTargets, bundleTargets []outputTarget
+		if hasOutput("textpack") {
+			packTargets = getOutputTargets("textpack", outputPath)
+		}
+		if hasOutput("textbundle") || len(packTargets) == 0 {
+			bundleTargets = getOutputTargets("textbundle", outputPath)
 		}
 
-		_, err = w.Write(result)
-		if err != nil {
-			log.Println(err)
-			return
+		fields := newNameFields(title, "", r.Form.Get("idx"), r.Form.Get("url"), r.Form.Get("tags"))
+		var results []imageResult
+		var outputs []outputResult
+		for _, target := range bundleTargets {
+			name := target.name(fields, title+".textbundle", ".textbundle")
+			outputs = append(outputs, writeOutput(target.Path, name, ".textbundle", bundleLayout("info.json", "text.markdown"), func(path string) error {
+				written, err := writeTextBundle(path, content, images)
+				if err == nil {
+					results = written
+				}
+				return err
+			}))
+		}
+		for _, target := range packTargets {
+			name := target.name(fields, title+".textpack", ".textpack")
+			outputs = append(outputs, writeOutput(target.Path, name, ".textpack", nil, func(path string) error {
+				written, err := writeTextPack(path, title, content, images)
+				if err == nil {
+					results = written
+				}
+				return err
+			}))
 		}
+
+		result := outputsResult(outputs)
+		writeResult(w, result.Status, struct {
+			syncResult
+			Images []imageResult `json:"images"`
+		}{syncResult: result, Images: results})
 		log.Println("save textbundle:", title)
 	}
 }
 
 // 校验 uid
-// 懒得精简代码，复制粘贴
 func notextbundleHandle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
 
@@ -925,6 +1187,7 @@ func notextbundleHandle(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseForm()
 		if err != nil {
 			log.Println(err)
+			writeError(w, http.StatusBadRequest, errorBadRequest, err.Error())
 			return
 		}
 		title := r.Form.Get("title")
@@ -932,78 +1195,53 @@ func notextbundleHandle(w http.ResponseWriter, r *http.Request) {
 		path := r.Form.Get("path")
 		if path == "" {
 			path = outputPath
-		}
-		images := matchImage.FindAllString(content, -1)
-		// TODO 提升性能
-		for _, path := range getOutputPathsWithPath("assets", path) {
-			filePath := filepath.Join(path, title)
-
-			err = os.Mkdir(filePath, 0755)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			err = os.Mkdir(filepath.Join(filePath, "assets"), 0755)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			for i, image := range images {
-				content = strings.Replace(content, image, fmt.Sprint("![](assets/", i, ".png)"), 1)
-				go func(i int, image string) {
-					image = matchReplace.ReplaceAllString(image, "")
-
-					resp, err := client.Get(image)
-					if err != nil {
-						log.Println(err)
-						return
-					}
-					defer resp.Body.Close()
-
-					body, err := io.ReadAll(resp.Body)
-					if err != nil {
-						log.Println(err)
-						return
-					}
-
-					err = os.WriteFile(filepath.Join(filePath, "assets", fmt.Sprint(i, ".png")), body, 0644)
-					if err != nil {
-						log.Println(err)
-						return
-					}
-				}(i, image)
-			}
-
-			err = os.WriteFile(filepath.Join(filePath, fmt.Sprint(title, ".md")), []byte(content), 0644)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-		}
-
-		result, err := json.Marshal(struct {
-			Status int `json:"status"`
-		}{Status: 200})
-		if err != nil {
-			log.Println(err)
+		} else if !withinRoots(path) {
+			log.Println(errOutsideRoots, path)
+			writeError(w, http.StatusForbidden, errorForbidden, errOutsideRoots.Error())
 			return
 		}
-
-		_, err = w.Write(result)
-		if err != nil {
-			log.Println(err)
+		images := downloadImages(r.Context(), content, r.Form.Get("url"))
+		if err := r.Context().Err(); err != nil {
+			log.Println("请求已取消：", title, err)
 			return
 		}
+		var results []imageResult
+		var outputs []outputResult
+		fields := newNameFields(title, "", r.Form.Get("idx"), r.Form.Get("url"), r.Form.Get("tags"))
+		for _, target := range getOutputTargets("assets", path) {
+			outputs = append(outputs, writeOutput(target.Path, target.name(fields, title, ""), "", bundleLayout(safeName(fmt.Sprint(title, ".md"))), func(filePath string) error {
+				err := os.Mkdir(filePath, 0755)
+				if err != nil {
+					return err
+				}
+				localized, r, err := images.localize(content, filePath)
+				if err != nil {
+					return err
+				}
+				results = r
+				return os.WriteFile(filepath.Join(filePath, safeName(fmt.Sprint(title, ".md"))), []byte(localized), 0644)
+			}))
+		}
+
+		result := outputsResult(outputs)
+		writeResult(w, result.Status, struct {
+			syncResult
+			Images []imageResult `json:"images"`
+		}{syncResult: result, Images: results})
 		log.Println("save notextbundle:", title)
 	}
 }
 
 func proxyHandle(w http.ResponseWriter, r *http.Request) {
 	url := r.URL.Query().Get("url")
+	if url == "" {
+		writeError(w, http.StatusBadRequest, errorBadRequest, "缺少 url")
+		return
+	}
 	resp, err := client.Get(url)
 	if err != nil {
 		log.Println("proxy error:", err)
+		writeError(w, http.StatusBadGateway, errorProxy, err.Error())
 		return
 	}
 	defer resp.Body.Close()
@@ -1025,179 +1263,115 @@ func APIaddHandle(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		log.Println(err)
+		writeAPIError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	url := r.Form.Get("url")
 	title := r.Form.Get("title")
 	desc := r.Form.Get("desc")
-	tags := strings.Split(r.Form.Get("tags"), ",")
+	tags := splitTags(r.Form.Get("tags"))
 	note := r.Form.Get("note")
 
-	config, err := os.ReadFile(filepath.Join(syncPath, "simpread_config.json"))
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	idx := int(gjson.GetBytes(config, "unrdist.#.idx|0").Int()) + 1
-	unrdist[idx] = struct{}{}
-	tmp := gjson.GetBytes(config, "unrdist|@reverse").String()
-	tmp, err = sjson.Set(tmp, "-1", map[string]interface{}{
-		"create":  time.Now().Format("2006年01月02日 15:04:05"), //2022年10月14日 19:59:58
-		"desc":    desc,
-		"favicon": "",
-		"idx":     idx,
-		"img":     "",
-		"note":    note,
-		"tags":    tags,
-		"title":   title,
-		"url":     url})
-	tmp = gjson.Get(tmp, "@this|@reverse").Raw
-	config, err = sjson.SetRawBytes(config, "unrdist", []byte(tmp))
-	err = os.WriteFile(filepath.Join(syncPath, "simpread_config.json"), config, 0644)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	result, err := json.Marshal(struct {
-		Code int `json:"code"`
-	}{Code: 201})
+	var unrd *Unrd
+	err = store.UpdateConfig(func(config *Config) error {
+		unrd = newUnrd(config.NextIdx(), title, url, desc, note, tags)
+		config.Prepend(unrd)
+		return nil
+	})
 	if err != nil {
 		log.Println(err)
+		writeAPIError(w, configErrorCode(err), err.Error())
 		return
 	}
+	writeAPIData(w, http.StatusCreated, unrd)
+}
 
-	_, err = w.Write(result)
-	if err != nil {
-		log.Println(err)
-		return
+// simpread_config.json 不存在时为 404，其余为 500
+func configErrorCode(err error) int {
+	if errors.Is(err, os.ErrNotExist) {
+		return http.StatusNotFound
 	}
+	return http.StatusInternalServerError
 }
 
 func APIaddsHandle(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		log.Println(err)
+		writeAPIError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	urls := strings.Split(r.Form.Get("urls"), ";;;")
 	titles := strings.Split(r.Form.Get("titles"), ";;;")
-	tags := strings.Split(r.Form.Get("tags"), ",")
-
-	config, err := os.ReadFile(filepath.Join(syncPath, "simpread_config.json"))
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	idx := int(gjson.GetBytes(config, "unrdist.#.idx|0").Int()) + 1
-	tmp := gjson.GetBytes(config, "unrdist|@reverse").String()
-	for i, url := range urls {
-		unrdist[idx] = struct{}{}
-		tmp, err = sjson.Set(tmp, "-1", map[string]interface{}{
-			"create":  time.Now().Format("2006年01月02日 15:04:05"), //2022年10月14日 19:59:58
-			"desc":    "",
-			"favicon": "",
-			"idx":     idx,
-			"img":     "",
-			"note":    "",
-			"tags":    tags,
-			"title":   titles[i],
-			"url":     url})
-		idx += 1
-	}
-	tmp = gjson.Get(tmp, "@this|@reverse").Raw
-	config, err = sjson.SetRawBytes(config, "unrdist", []byte(tmp))
-	err = os.WriteFile(filepath.Join(syncPath, "simpread_config.json"), config, 0644)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	result, err := json.Marshal(struct {
-		Code int `json:"code"`
-	}{Code: 201})
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	_, err = w.Write(result)
+	tags := splitTags(r.Form.Get("tags"))
+
+	var items []*Unrd
+	err = store.UpdateConfig(func(config *Config) error {
+		idx := config.NextIdx()
+		items = make([]*Unrd, 0, len(urls))
+		for i, url := range urls {
+			var title string
+			if i < len(titles) {
+				title = titles[i]
+			}
+			items = append(items, newUnrd(idx+i, title, url, "", "", tags))
+		}
+		config.Prepend(items...)
+		return nil
+	})
 	if err != nil {
 		log.Println(err)
+		writeAPIError(w, configErrorCode(err), err.Error())
 		return
 	}
+	writeAPIData(w, http.StatusCreated, items)
 }
 
 func APIreadingHandle(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		log.Println(err)
+		writeAPIError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	var files []map[string]string
-	fileInfo, err := os.ReadDir(outputPath)
+	files, err := readingFiles()
 	if err != nil {
 		log.Println(err)
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	for _, file := range fileInfo {
-		if !file.IsDir() {
-			fileinfo, _ := file.Info()
-			files = append(files, map[string]string{
-				"title":  file.Name(),
-				"create": fileinfo.ModTime().Format("Mon, 02 Jan 2006 15:04:05 MST")})
-		}
-	}
 
-	var result []byte
 	query := r.Form.Get("title")
 	if query == "index" {
-		w.Header().Set("content-type", "application/json")
-		result, err = json.Marshal(struct {
-			Data []map[string]string `json:"data"`
-		}{Data: files})
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		log.Println("API reading index")
-	} else {
-		id := strings.Replace(r.URL.Path, "/reading/", "", 1)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		suffix := ".html"
-		var title string
+		list := []map[string]string{}
 		for _, file := range files {
-			if (strings.HasPrefix(file["title"], id+"-") &&
-				strings.HasSuffix(file["title"], suffix) &&
-				!strings.Contains(file["title"], "@annote")) ||
-				file["title"] == id+suffix ||
-				file["title"] == query+suffix {
-				title = file["title"]
-				break
-			}
-		}
-
-		if title != "" {
-			result, err = os.ReadFile(filepath.Join(outputPath, title))
+			info, err := os.Stat(file.path)
 			if err != nil {
-				log.Println(err)
-				return
-			}
-			log.Println("API reading file:", title)
-		} else {
-			w.Header().Set("content-type", "application/json")
-			result, err = json.Marshal(struct {
-				Code    int    `json:"code"`
-				Message string `json:"message"`
-			}{Code: 404, Message: "没有找到对应的内容"})
-			if err != nil {
-				log.Println(err)
-				return
+				continue
 			}
+			list = append(list, map[string]string{
+				"title":  file.name,
+				"create": info.ModTime().Format("Mon, 02 Jan 2006 15:04:05 MST")})
 		}
+		log.Println("API reading index")
+		writeAPIData(w, http.StatusOK, list)
+		return
+	}
+
+	id := strings.Replace(r.URL.Path, "/reading/", "", 1)
+	file, ok := findReading(files, id, query, ".html")
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "没有找到对应的内容")
+		return
+	}
+	result, err := os.ReadFile(file.path)
+	if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
+	log.Println("API reading file:", file.name)
 	_, err = w.Write(result)
 	if err != nil {
 		log.Println(err)
@@ -1209,61 +1383,16 @@ func APIlistHandle(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		log.Println(err)
+		writeAPIError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	filter := r.Form.Get("filter")
-	value := r.Form.Get("value")
-	var result []byte
-	switch filter {
-	case "all":
-		config, err := os.ReadFile(filepath.Join(syncPath, "simpread_config.json"))
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		unrdist := gjson.GetBytes(config, "unrdist").Array()
-		tmp := `{"data": []}`
-		for i := 0; i < 20 && i < len(unrdist); i++ {
-			tmp, _ = sjson.SetRaw(tmp, "data.-1", unrdist[i].Raw)
-		}
-		result = []byte(tmp)
-		w.Header().Set("content-type", "application/json")
-	case "daily":
-		config, err := os.ReadFile(filepath.Join(syncPath, "simpread_config.json"))
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		unrdist := gjson.GetBytes(config, "unrdist").Array()
-		now := time.Now()
-		tmp := `{"data": []}`
-		for _, unrd := range unrdist {
-			create, _ := time.Parse("2006年01月02日 15:04:05", unrd.Get("create").String())
-			if create.Year() == now.Year() && create.Month() == now.Month() &&
-				create.Day() == now.Day() {
-				tmp, _ = sjson.SetRaw(tmp, "data.-1", unrd.Raw)
-			}
-		}
-		result = []byte(tmp)
-		w.Header().Set("content-type", "application/json")
-	case "dr":
-		config, err := os.ReadFile(filepath.Join(syncPath, "simpread_config.json"))
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		tmp := `{"data": []}`
-		for _, unrd := range gjson.GetBytes(config, `unrdist.#(tags.#(=="dr"))`).Array() {
-			tmp, _ = sjson.SetRaw(tmp, "data.-1", unrd.Raw)
-		}
-		result = []byte(tmp)
-		w.Header().Set("content-type", "application/json")
-	case "reading":
-		var files []map[string]string
+	if r.Form.Get("filter") == "reading" {
+		files := []map[string]string{}
 		fileInfo, err := os.ReadDir(outputPath)
 		if err != nil {
 			log.Println(err)
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 		for _, file := range fileInfo {
@@ -1274,50 +1403,31 @@ func APIlistHandle(w http.ResponseWriter, r *http.Request) {
 					"create": fileinfo.ModTime().Format("Mon, 02 Jan 2006 15:04:05 MST")})
 			}
 		}
-		w.Header().Set("content-type", "application/json")
-		result, err = json.Marshal(struct {
-			Data []map[string]string `json:"data"`
-		}{Data: files})
-		if err != nil {
-			log.Println(err)
-			return
-		}
 		log.Println("API reading index")
-	case "tag":
-		config, err := os.ReadFile(filepath.Join(syncPath, "simpread_config.json"))
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		tmp := `{"data": []}`
-		for _, unrd := range gjson.GetBytes(config, fmt.Sprintf(`unrdist.#(tags.#(=="%s"))`, value)).
-			Array() {
-			tmp, _ = sjson.SetRaw(tmp, "data.-1", unrd.Raw)
-		}
-		result = []byte(tmp)
-		w.Header().Set("content-type", "application/json")
-	case "search":
-		config, err := os.ReadFile(filepath.Join(syncPath, "simpread_config.json"))
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		unrdist := gjson.GetBytes(config, "unrdist").Array()
-		tmp := `{"data": []}`
-		for _, unrd := range unrdist {
-			if strings.Contains(unrd.Get("title").String(), value) ||
-				strings.Contains(unrd.Get("desc").String(), value) ||
-				strings.Contains(unrd.Get("note").String(), value) {
-				tmp, _ = sjson.SetRaw(tmp, "data.-1", unrd.Raw)
-			}
-		}
-		result = []byte(tmp)
+		writeAPIData(w, http.StatusOK, files)
+		return
 	}
-	_, err = w.Write(result)
+
+	q, err := parseListQuery(r.Form)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	config, err := store.LoadConfig()
 	if err != nil {
 		log.Println(err)
+		writeAPIError(w, configErrorCode(err), err.Error())
 		return
 	}
+	data, total := q.apply(config.Unrdist)
+	w.Header().Set("content-type", "application/json")
+	writeResult(w, http.StatusOK, struct {
+		Code   int     `json:"code"`
+		Data   []*Unrd `json:"data"`
+		Total  int     `json:"total"`
+		Offset int     `json:"offset"`
+		Limit  int     `json:"limit"`
+	}{Code: http.StatusOK, Data: data, Total: total, Offset: q.Offset, Limit: q.Limit})
 }
 
 func main() {
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAPIaddHandle(t *testing.T) {
+	defer func(path string, s *configStore) { syncPath, store = path, s }(syncPath, store)
+	syncPath = t.TempDir()
+	store = newConfigStore(filepath.Join(syncPath, "simpread_config.json"))
+	add := func(handler http.HandlerFunc, form url.Values) (int, map[string]json.RawMessage) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/add", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		var body map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%d %q: %v", w.Code, w.Body, err)
+		}
+		return w.Code, body
+	}
+
+	// simpread_config.json 不存在时不能返回成功
+	if code, body := add(APIaddHandle, url.Values{"url": {"https://a.test"}}); code != http.StatusNotFound || body["message"] == nil {
+		t.Errorf("add without config = %d %s", code, body)
+	}
+
+	if err := os.WriteFile(store.path, []byte(`{"unrdist":[]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	code, body := add(APIaddHandle, url.Values{"url": {"https://a.test"}, "title": {"a"}})
+	var unrd Unrd
+	if code != http.StatusCreated || json.Unmarshal(body["data"], &unrd) != nil || unrd.Idx != 1 || unrd.Title != "a" {
+		t.Errorf("add = %d %s", code, body)
+	}
+	code, body = add(APIaddsHandle, url.Values{"urls": {"https://b.test;;;https://c.test"}, "titles": {"b;;;c"}})
+	var items []Unrd
+	if code != http.StatusCreated || json.Unmarshal(body["data"], &items) != nil || len(items) != 2 || items[1].Idx != 3 {
+		t.Errorf("adds = %d %s", code, body)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+// 用于内置 EPUB 导出的 Markdown 转换，支持 CommonMark 以及表格和删除线；
+// 文章中的 HTML 原样保留，由 epubXHTML 统一整理为 XHTML；EPUB3 不支持 align 属性，表格对齐使用 style
+var markdown = goldmark.New(
+	goldmark.WithExtensions(
+		extension.NewTable(extension.WithTableCellAlignMethod(extension.TableCellAlignStyle)),
+		extension.Strikethrough,
+	),
+	goldmark.WithRendererOptions(html.WithUnsafe(), html.WithXHTML()),
+)
+
+func markdownToHTML(content string) string {
+	var buf bytes.Buffer
+	err := markdown.Convert([]byte(content), &buf)
+	if err != nil {
+		log.Println(err)
+	}
+	return buf.String()
+}
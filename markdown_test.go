@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarkdownToHTML(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"heading", "# 标题", []string{"<h1>标题</h1>"}},
+		{"emphasis", "**粗体** 和 *斜体*", []string{"<strong>粗体</strong>", "<em>斜体</em>"}},
+		{"nested list", "- a\n  - b\n- c", []string{"<ul>\n<li>a\n<ul>\n<li>b</li>", "<li>c</li>"}},
+		{"ordered list", "1. a\n2. b", []string{"<ol>", "<li>b</li>"}},
+		{"fenced code", "```go\na < b\n```", []string{`<pre><code class="language-go">a &lt; b`}},
+		{"reference image", "![图][x]\n\n[x]: <a b.png> \"t\"", []string{`<img src="a%20b.png" alt="图" title="t" />`}},
+		{"lone angle bracket", "[0]:<", []string{"<p>[0]:&lt;</p>"}},
+		{"empty angle brackets", "[a]\n\n[a]: <>", []string{`<a href="">a</a>`}},
+		{"table", "| a | b |\n| - | :-: |\n| 1 | 2 |", []string{"<table>", "<th>a</th>", `<td style="text-align:center">2</td>`}},
+		{"strikethrough", "~~删除~~", []string{"<del>删除</del>"}},
+		{"raw html", "<div class=\"note\">\n\n正文\n\n</div>", []string{`<div class="note">`, "<p>正文</p>"}},
+		{"xhtml", "a  \nb\n\n---", []string{"<br />", "<hr />"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := markdownToHTML(tt.content)
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("markdownToHTML(%q) = %q, want to contain %q", tt.content, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// unrdist 中 create 字段的格式，例如 2022年10月14日 19:59:58
+const createLayout = "2006年01月02日 15:04:05"
+
+// 稍后读中的一项，未声明的字段保存在 extra 中，序列化时原样写回
+type Unrd struct {
+	Idx         int             `json:"idx"`
+	Create      string          `json:"create"`
+	Title       string          `json:"title"`
+	URL         string          `json:"url"`
+	Desc        string          `json:"desc"`
+	Note        string          `json:"note"`
+	Tags        []string        `json:"tags"`
+	Favicon     string          `json:"favicon"`
+	Img         string          `json:"img"`
+	Annotations json.RawMessage `json:"annotations,omitempty"`
+
+	extra map[string]json.RawMessage
+}
+
+// 避免 MarshalJSON/UnmarshalJSON 递归
+type unrdFields Unrd
+
+func (u *Unrd) UnmarshalJSON(data []byte) error {
+	var fields unrdFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for _, key := range unrdKeys {
+		delete(all, key)
+	}
+	*u = Unrd(fields)
+	if len(all) > 0 {
+		u.extra = all
+	}
+	return nil
+}
+
+func (u Unrd) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(unrdFields(u))
+	if err != nil || len(u.extra) == 0 {
+		return data, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	for k, v := range u.extra {
+		if _, ok := all[k]; !ok {
+			all[k] = v
+		}
+	}
+	return json.Marshal(all)
+}
+
+var unrdKeys = []string{"idx", "create", "title", "url", "desc", "note", "tags", "favicon", "img", "annotations"}
+
+func newUnrd(idx int, title, url, desc, note string, tags []string) *Unrd {
+	if tags == nil {
+		tags = []string{}
+	}
+	return &Unrd{
+		Idx:    idx,
+		Create: time.Now().Format(createLayout),
+		Title:  title,
+		URL:    url,
+		Desc:   desc,
+		Note:   note,
+		Tags:   tags,
+	}
+}
+
+func (u *Unrd) CreateTime() (time.Time, error) {
+	return time.ParseInLocation(createLayout, u.Create, time.Local)
+}
+
+func (u *Unrd) HasTag(tag string) bool {
+	for _, t := range u.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// simpread_config.json，除 unrdist 外的内容保持原样
+type Config struct {
+	raw     []byte
+	Unrdist []*Unrd
+}
+
+func parseConfig(data []byte) (*Config, error) {
+	config := &Config{raw: data, Unrdist: []*Unrd{}}
+	if raw := gjson.GetBytes(data, "unrdist"); raw.Exists() {
+		if err := json.Unmarshal([]byte(raw.Raw), &config.Unrdist); err != nil {
+			return nil, err
+		}
+	} else if !gjson.ValidBytes(data) {
+		return nil, errors.New("invalid config json")
+	}
+	return config, nil
+}
+
+func (c *Config) Bytes() ([]byte, error) {
+	unrdist, err := json.Marshal(c.Unrdist)
+	if err != nil {
+		return nil, err
+	}
+	return sjson.SetRawBytes(c.raw, "unrdist", unrdist)
+}
+
+// 取最大的 idx + 1，不依赖 unrdist 的顺序
+func (c *Config) NextIdx() int {
+	next := 1
+	for _, u := range c.Unrdist {
+		if u.Idx >= next {
+			next = u.Idx + 1
+		}
+	}
+	return next
+}
+
+// unrdist 按 idx 从新到旧排列，新加入的项放在最前面
+func (c *Config) Prepend(items ...*Unrd) {
+	unrdist := make([]*Unrd, 0, len(items)+len(c.Unrdist))
+	for i := len(items) - 1; i >= 0; i-- {
+		unrdist = append(unrdist, items[i])
+	}
+	c.Unrdist = append(unrdist, c.Unrdist...)
+}
+
+func (c *Config) Find(idx int) (int, *Unrd) {
+	for i, u := range c.Unrdist {
+		if u.Idx == idx {
+			return i, u
+		}
+	}
+	return -1, nil
+}
+
+func (c *Config) IdxSet() map[int]struct{} {
+	set := make(map[int]struct{}, len(c.Unrdist))
+	for _, u := range c.Unrdist {
+		set[u.Idx] = struct{}{}
+	}
+	return set
+}
+
+func (s *configStore) LoadConfig() (*Config, error) {
+	data, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+// 供只读的查询使用，文件的修改时间和大小不变时不再重新读取和解析；返回的 Config 不能修改
+func (s *configStore) CachedConfig() (*Config, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	s.cacheMu.Lock()
+	config := s.cache
+	if config != nil && info.ModTime().Equal(s.cacheMod) && info.Size() == s.cacheSize {
+		s.cacheMu.Unlock()
+		return config, nil
+	}
+	s.cacheMu.Unlock()
+
+	// 读取时不持有 cacheMu，Update 在持有 s.mu 时会清空缓存；
+	// 之后文件又有变化时修改时间不同，下次会重新读取
+	config, err = s.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	s.cacheMu.Lock()
+	s.cache, s.cacheMod, s.cacheSize = config, info.ModTime(), info.Size()
+	s.cacheMu.Unlock()
+	return config, nil
+}
+
+// 与 Update 相同，但以 Config 的形式修改
+func (s *configStore) UpdateConfig(fn func(config *Config) error) error {
+	return s.Update(func(data []byte) ([]byte, error) {
+		if data == nil {
+			return nil, os.ErrNotExist
+		}
+		config, err := parseConfig(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(config); err != nil {
+			return nil, err
+		}
+		unrdist = config.IdxSet()
+		return config.Bytes()
+	})
+}
+
+func splitTags(s string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestConfigRoundTrip(t *testing.T) {
+	data := []byte(`{"version":"2.2.0","option":{"theme":"dark"},"unrdist":[` +
+		`{"idx":2,"create":"2022年10月14日 19:59:58","title":"b","url":"https://b.test","desc":"","note":"","tags":["dr"],"favicon":"","img":"","custom":{"x":1}},` +
+		`{"idx":1,"create":"2022年10月13日 08:00:00","title":"a","url":"https://a.test","desc":"","note":"","tags":[],"favicon":"","img":"","annotations":[{"id":1}]}]}`)
+	config, err := parseConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Unrdist) != 2 || config.Unrdist[0].Title != "b" || !config.Unrdist[0].HasTag("dr") {
+		t.Fatalf("parseConfig unrdist = %+v", config.Unrdist)
+	}
+	if next := config.NextIdx(); next != 3 {
+		t.Errorf("NextIdx = %d, want 3", next)
+	}
+
+	config.Unrdist[0].Title = "c"
+	config.Prepend(newUnrd(3, "d", "https://d.test", "", "", nil), newUnrd(4, "e", "https://e.test", "", "", nil))
+	out, err := config.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 未声明的字段和 unrdist 以外的内容原样保留
+	for path, want := range map[string]string{
+		"version":                 `"2.2.0"`,
+		"option":                  `{"theme":"dark"}`,
+		"unrdist.#.idx":           `[4,3,2,1]`,
+		"unrdist.2.title":         `"c"`,
+		"unrdist.2.custom":        `{"x":1}`,
+		"unrdist.3.annotations":   `[{"id":1}]`,
+		"unrdist.0.tags":          `[]`,
+		"unrdist.0.annotations":   ``,
+		"unrdist.1.custom":        ``,
+		"unrdist.3.create":        `"2022年10月13日 08:00:00"`,
+		"unrdist.2.tags":          `["dr"]`,
+		"unrdist.2.url":           `"https://b.test"`,
+		"unrdist.#(idx==1).title": `"a"`,
+	} {
+		var got string
+		if v := gjson.GetBytes(out, path); v.Exists() {
+			got = v.Raw
+		}
+		if compactJSON(got) != compactJSON(want) {
+			t.Errorf("%s = %s, want %s", path, got, want)
+		}
+	}
+
+	if _, err := parseConfig([]byte(`{"version":`)); err == nil {
+		t.Error("parseConfig with invalid json succeeded")
+	}
+	if config, err := parseConfig([]byte(`{}`)); err != nil || len(config.Unrdist) != 0 {
+		t.Errorf("parseConfig without unrdist = %v, %v", config, err)
+	}
+}
+
+func compactJSON(s string) string {
+	var v interface{}
+	if json.Unmarshal([]byte(s), &v) != nil {
+		return s
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func TestSplitTags(t *testing.T) {
+	if got := splitTags(" a, ,b,"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("splitTags = %q", got)
+	}
+	if got := splitTags(""); got == nil || len(got) != 0 {
+		t.Errorf("splitTags(\"\") = %#v", got)
+	}
+}
+
+func TestCachedConfig(t *testing.T) {
+	defer func(path string) { syncPath = path }(syncPath)
+	syncPath = t.TempDir()
+	s := newConfigStore(filepath.Join(syncPath, "simpread_config.json"))
+	if _, err := s.CachedConfig(); !os.IsNotExist(err) {
+		t.Errorf("CachedConfig without file = %v", err)
+	}
+	if err := os.WriteFile(s.path, []byte(`{"unrdist":[{"idx":1,"title":"a"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := s.CachedConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := s.CachedConfig(); b != a {
+		t.Error("unchanged config was parsed again")
+	}
+	err = s.UpdateConfig(func(config *Config) error {
+		config.Unrdist[0].Title = "b"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := s.CachedConfig(); err != nil || c.Unrdist[0].Title != "b" {
+		t.Errorf("CachedConfig after update = %v, %v", c, err)
+	}
+}
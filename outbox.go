@@ -0,0 +1,458 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+var (
+	mailRetries       int
+	mailRetryInterval time.Duration
+)
+
+// 重试间隔每次翻倍，最长为 maxMailBackoff
+const maxMailBackoff = time.Hour
+
+// 已发送的邮件保留的时间，启动时清理
+const mailRetention = 7 * 24 * time.Hour
+
+// 待发送的邮件，状态保存在 syncPath/outbox/{id}.json，
+// 正文和附件分别保存在 {id}.html 和 {id}.attach 中，发送成功后删除
+type outboxMail struct {
+	ID         string     `json:"id"`
+	To         string     `json:"to"`
+	Subject    string     `json:"subject"`
+	Attachment string     `json:"attachment,omitempty"` // 附件在邮件中的文件名
+	Source     string     `json:"source,omitempty"`     // 附件原本的 tmp- 文件，发送成功后删除
+	Status     string     `json:"status"`               // queued、sending、sent、failed
+	Attempts   int        `json:"attempts"`
+	Error      string     `json:"error,omitempty"`
+	Created    time.Time  `json:"created"`
+	Next       *time.Time `json:"next,omitempty"`
+	Sent       *time.Time `json:"sent,omitempty"`
+
+	// 每次尝试发送后关闭并替换
+	attempted chan struct{}
+}
+
+var errMailNotFound = errors.New("没有找到对应的邮件")
+
+type mailOutbox struct {
+	mu     sync.Mutex
+	dir    string
+	mails  map[string]*outboxMail
+	wake   chan struct{}
+	stop   chan struct{}
+	closed bool
+}
+
+var outbox *mailOutbox
+
+// 读取 dir 中保存的邮件，发送中的说明服务曾意外退出，重新排队
+func openOutbox(dir string) *mailOutbox {
+	o := &mailOutbox{
+		dir:   dir,
+		mails: map[string]*outboxMail{},
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		log.Println(err)
+		return o
+	}
+	fileInfo, err := os.ReadDir(dir)
+	if err != nil {
+		log.Println(err)
+		return o
+	}
+	for _, file := range fileInfo {
+		id := strings.TrimSuffix(file.Name(), ".json")
+		if file.IsDir() || id == file.Name() || strings.HasPrefix(id, ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		m := &outboxMail{attempted: make(chan struct{})}
+		if err := json.Unmarshal(data, m); err != nil || m.ID != id {
+			log.Println("邮件状态有误：", file.Name())
+			continue
+		}
+		if m.Sent != nil && time.Since(*m.Sent) > mailRetention {
+			o.remove(m)
+			continue
+		}
+		if m.Status == "sending" {
+			m.Status = "queued"
+			o.save(m)
+		}
+		o.mails[m.ID] = m
+	}
+	return o
+}
+
+// 启动发送邮件的 worker，Close 后不再开始新的发送
+func (o *mailOutbox) Start() {
+	go o.work()
+}
+
+func (o *mailOutbox) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.closed {
+		o.closed = true
+		close(o.stop)
+	}
+}
+
+func (o *mailOutbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *mailOutbox) work() {
+	for {
+		o.mu.Lock()
+		if o.closed {
+			o.mu.Unlock()
+			return
+		}
+		m, wait := o.next()
+		if m != nil {
+			m.Status = "sending"
+			o.save(m)
+			// 关闭时等待正在发送的邮件
+			jobs.Add(1)
+		}
+		o.mu.Unlock()
+
+		if m == nil {
+			timer := time.NewTimer(wait)
+			select {
+			case <-o.wake:
+			case <-timer.C:
+			case <-o.stop:
+			}
+			timer.Stop()
+			continue
+		}
+		err := o.send(m)
+		o.mu.Lock()
+		o.finish(m, err)
+		o.mu.Unlock()
+		jobs.Done()
+	}
+}
+
+// 调用时需持有 o.mu，返回最早到期的邮件，没有时返回距下一封到期的时间
+func (o *mailOutbox) next() (*outboxMail, time.Duration) {
+	var due *outboxMail
+	wait := time.Hour
+	now := time.Now()
+	for _, m := range o.mails {
+		if m.Status != "queued" {
+			continue
+		}
+		if m.Next == nil || !m.Next.After(now) {
+			if due == nil || m.Created.Before(due.Created) {
+				due = m
+			}
+		} else if d := m.Next.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	return due, wait
+}
+
+func (o *mailOutbox) send(m *outboxMail) error {
+	body, err := os.ReadFile(filepath.Join(o.dir, m.ID+".html"))
+	if err != nil {
+		return err
+	}
+	msg := gomail.NewMessage()
+	msg.SetHeader("From", smtpUsername)
+	msg.SetHeader("To", m.To)
+	msg.SetHeader("Subject", m.Subject)
+	msg.SetBody("text/html", string(body))
+	if m.Attachment != "" {
+		msg.Attach(filepath.Join(o.dir, m.ID+".attach"), gomail.Rename(mime.QEncoding.Encode("utf-8", m.Attachment)))
+	}
+
+	d := gomail.NewDialer(smtpHost, smtpPort, smtpUsername, smtpPassword)
+	d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	s, err := d.Dial()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return gomail.Send(s, msg)
+}
+
+// 调用时需持有 o.mu，失败超过 mailRetries 次后不再重试
+func (o *mailOutbox) finish(m *outboxMail, err error) {
+	now := time.Now()
+	m.Attempts++
+	m.Next = nil
+	if err == nil {
+		m.Status = "sent"
+		m.Error = ""
+		m.Sent = &now
+		o.removeFiles(m)
+		if m.Source != "" {
+			if err := os.Remove(m.Source); err != nil && !os.IsNotExist(err) {
+				log.Println(err)
+			}
+		}
+		log.Println("send mail:", m.Subject)
+	} else if m.Attempts > mailRetries {
+		m.Status = "failed"
+		m.Error = err.Error()
+		log.Println("邮件发送失败：", m.Subject, err)
+	} else {
+		backoff := mailRetryInterval << (m.Attempts - 1)
+		if backoff > maxMailBackoff || backoff <= 0 {
+			backoff = maxMailBackoff
+		}
+		next := now.Add(backoff)
+		m.Status = "queued"
+		m.Error = err.Error()
+		m.Next = &next
+		log.Println("邮件发送失败，", backoff, "后重试：", m.Subject, err)
+	}
+	o.save(m)
+	close(m.attempted)
+	m.attempted = make(chan struct{})
+}
+
+// 调用时需持有 o.mu
+func (o *mailOutbox) save(m *outboxMail) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = writeFileAtomic(filepath.Join(o.dir, m.ID+".json"), data, 0600)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (o *mailOutbox) removeFiles(m *outboxMail) {
+	for _, ext := range []string{".html", ".attach"} {
+		err := os.Remove(filepath.Join(o.dir, m.ID+ext))
+		if err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+}
+
+func (o *mailOutbox) remove(m *outboxMail) {
+	o.removeFiles(m)
+	err := os.Remove(filepath.Join(o.dir, m.ID+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+}
+
+// 正文和附件先复制到 outbox 中再排队，attachPath 为空时没有附件；
+// 返回的副本中的 attempted 在第一次发送结束后关闭
+func (o *mailOutbox) Add(to, subject, body, attachPath, attachName string) (outboxMail, error) {
+	id, err := newJobID()
+	if err != nil {
+		return outboxMail{}, err
+	}
+	m := &outboxMail{
+		ID:        id,
+		To:        to,
+		Subject:   subject,
+		Status:    "queued",
+		Created:   time.Now(),
+		attempted: make(chan struct{}),
+	}
+	err = writeFileAtomic(filepath.Join(o.dir, id+".html"), []byte(body), 0600)
+	if err != nil {
+		return outboxMail{}, err
+	}
+	if attachPath != "" {
+		m.Attachment = attachName
+		m.Source = attachPath
+		err = copyFile(attachPath, filepath.Join(o.dir, id+".attach"))
+		if err != nil {
+			o.removeFiles(m)
+			return outboxMail{}, err
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.mails[id] = m
+	o.save(m)
+	o.notify()
+	return *m, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (o *mailOutbox) Get(id string) (outboxMail, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	m, ok := o.mails[id]
+	if !ok {
+		return outboxMail{}, fmt.Errorf("%w: %s", errMailNotFound, id)
+	}
+	return *m, nil
+}
+
+// 按创建时间从新到旧排列，status 不为空时只返回对应状态的邮件
+func (o *mailOutbox) List(status string) []outboxMail {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	list := []outboxMail{}
+	for _, m := range o.mails {
+		if status == "" || m.Status == status {
+			list = append(list, *m)
+		}
+	}
+	sort.Slice(list, func(i, k int) bool {
+		return list[i].Created.After(list[k].Created)
+	})
+	return list
+}
+
+// 尚未发送成功的邮件引用的 tmp- 文件（绝对路径），清理临时文件时需要保留
+func (o *mailOutbox) Sources() map[string]struct{} {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	sources := map[string]struct{}{}
+	for _, m := range o.mails {
+		if m.Source == "" || m.Status == "sent" {
+			continue
+		}
+		if path, err := filepath.Abs(m.Source); err == nil {
+			sources[path] = struct{}{}
+		}
+	}
+	return sources
+}
+
+// 立即重新发送排队中或已放弃的邮件，重试次数从头计算
+func (o *mailOutbox) Retry(id string) (outboxMail, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	m, ok := o.mails[id]
+	if !ok {
+		return outboxMail{}, fmt.Errorf("%w: %s", errMailNotFound, id)
+	}
+	if m.Status == "queued" || m.Status == "failed" {
+		m.Status = "queued"
+		m.Attempts = 0
+		m.Next = nil
+		o.save(m)
+		o.notify()
+	}
+	return *m, nil
+}
+
+// 删除邮件及其正文和附件，正在发送的邮件不会被删除；
+// id 为空时删除所有状态为 status 的邮件（status 也为空时为已发送和已放弃的邮件）
+func (o *mailOutbox) Purge(id, status string) ([]string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if id != "" {
+		m, ok := o.mails[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errMailNotFound, id)
+		}
+		if m.Status == "sending" {
+			return nil, fmt.Errorf("邮件正在发送：%s", id)
+		}
+		o.remove(m)
+		delete(o.mails, id)
+		return []string{id}, nil
+	}
+	purged := []string{}
+	for id, m := range o.mails {
+		if status == "" && (m.Status == "sent" || m.Status == "failed") ||
+			status != "" && status != "sending" && m.Status == status {
+			o.remove(m)
+			delete(o.mails, id)
+			purged = append(purged, id)
+		}
+	}
+	sort.Strings(purged)
+	return purged, nil
+}
+
+// /outbox?status=failed       GET 列出邮件，DELETE 删除已发送和已放弃（或 status 对应）的邮件
+// /outbox/{id}                GET 获取邮件状态，DELETE 删除邮件
+// /outbox/{id}/retry          POST 立即重新发送
+func APIoutboxHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	id, action, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/outbox"), "/"), "/")
+	status := r.URL.Query().Get("status")
+
+	var data interface{}
+	var err error
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		data = outbox.List(status)
+	case id == "" && r.Method == http.MethodDelete:
+		data, err = outbox.Purge("", status)
+	case action == "" && r.Method == http.MethodGet:
+		data, err = outbox.Get(id)
+	case action == "" && r.Method == http.MethodDelete:
+		data, err = outbox.Purge(id, "")
+	case action == "retry" && r.Method == http.MethodPost:
+		data, err = outbox.Retry(id)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, r.Method+" "+r.URL.Path)
+		return
+	}
+	if errors.Is(err, errMailNotFound) {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if r.Method != http.MethodGet {
+		log.Println("API outbox:", r.Method, r.URL.Path)
+	}
+	writeAPIData(w, http.StatusOK, data)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 只实现发送邮件需要的命令，reject 为 true 时拒绝连接
+func fakeSMTP(t *testing.T, reject *atomic.Bool) (string, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				if reject.Load() {
+					conn.Write([]byte("421 busy\r\n"))
+					return
+				}
+				conn.Write([]byte("220 test\r\n"))
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+					case "DATA":
+						conn.Write([]byte("354 go on\r\n"))
+						for line != ".\r\n" {
+							if line, err = r.ReadString('\n'); err != nil {
+								return
+							}
+						}
+						conn.Write([]byte("250 ok\r\n"))
+					case "QUIT":
+						conn.Write([]byte("221 bye\r\n"))
+						return
+					default:
+						conn.Write([]byte("250 ok\r\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func waitMail(t *testing.T, o *mailOutbox, id, status string) outboxMail {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		m, err := o.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Status == status {
+			return m
+		} else if time.Now().After(deadline) {
+			t.Fatalf("mail is %s %s, want %s", m.Status, m.Error, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	var reject atomic.Bool
+	reject.Store(true)
+	smtpHost, smtpPort = fakeSMTP(t, &reject)
+	smtpUsername, smtpPassword = "me@example.com", ""
+	mailRetries, mailRetryInterval = 1, time.Hour
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "tmp-a.epub")
+	if err := os.WriteFile(source, []byte("epub"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	o := openOutbox(filepath.Join(dir, "outbox"))
+	o.Start()
+	defer o.Close()
+
+	// 第一次失败后按间隔重试，超过 mailRetries 次后放弃
+	m, err := o.Add("kindle@example.com", "标题", "<p>正文</p>", source, "标题.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-m.attempted
+	if m, _ := o.Get(m.ID); m.Status != "queued" || m.Attempts != 1 || m.Error == "" || m.Next == nil {
+		t.Errorf("mail after first failure is %s, %d attempts, next %v", m.Status, m.Attempts, m.Next)
+	}
+	// 不等待重试间隔，直接到期
+	o.mu.Lock()
+	now := time.Now()
+	o.mails[m.ID].Next = &now
+	o.mu.Unlock()
+	o.notify()
+	m = waitMail(t, o, m.ID, "failed")
+	if m.Attempts != 2 || m.Next != nil {
+		t.Errorf("failed mail has %d attempts, next %v", m.Attempts, m.Next)
+	}
+
+	// 手动重试后发送成功，正文、附件和原本的 tmp- 文件都被删除
+	reject.Store(false)
+	if m, err := o.Retry(m.ID); err != nil || m.Status != "queued" || m.Attempts != 0 {
+		t.Errorf("Retry = %s %d, %v", m.Status, m.Attempts, err)
+	}
+	m = waitMail(t, o, m.ID, "sent")
+	if m.Sent == nil || m.Error != "" {
+		t.Errorf("sent mail = %+v", m)
+	}
+	for _, path := range []string{source, filepath.Join(o.dir, m.ID+".html"), filepath.Join(o.dir, m.ID+".attach")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s not removed: %v", filepath.Base(path), err)
+		}
+	}
+
+	if list := o.List("sent"); len(list) != 1 || list[0].ID != m.ID {
+		t.Errorf("List(sent) = %v", list)
+	}
+	if purged, err := o.Purge("", ""); err != nil || len(purged) != 1 || purged[0] != m.ID {
+		t.Errorf("Purge = %v, %v", purged, err)
+	}
+	if _, err := o.Get(m.ID); !errors.Is(err, errMailNotFound) {
+		t.Errorf("Get after Purge = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(o.dir, m.ID+".json")); !os.IsNotExist(err) {
+		t.Errorf("purged mail state not removed: %v", err)
+	}
+}
+
+// 重启后发送中的邮件重新排队，超过保留时间的已发送邮件被清理
+func TestOutboxRestore(t *testing.T) {
+	dir := t.TempDir()
+	o := openOutbox(dir)
+	sent := time.Now().Add(-mailRetention - time.Hour)
+	o.mu.Lock()
+	o.save(&outboxMail{ID: "sending", Status: "sending", Created: time.Now()})
+	o.save(&outboxMail{ID: "old", Status: "sent", Created: sent, Sent: &sent})
+	o.mu.Unlock()
+
+	o = openOutbox(dir)
+	if m, err := o.Get("sending"); err != nil || m.Status != "queued" {
+		t.Errorf("restored sending mail is %s, %v", m.Status, err)
+	}
+	if _, err := o.Get("old"); !errors.Is(err, errMailNotFound) {
+		t.Errorf("expired mail was restored: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old.json")); !os.IsNotExist(err) {
+		t.Errorf("expired mail state not removed: %v", err)
+	}
+}
+
+// 尚未发送成功的邮件的附件不会被当作临时文件清理
+func TestCleanTmpFilesKeepsAttachments(t *testing.T) {
+	defer func(s, o string, e []map[string]string, ob *mailOutbox) {
+		syncPath, outputPath, enhancedOutput, outbox = s, o, e, ob
+	}(syncPath, outputPath, enhancedOutput, outbox)
+	syncPath, outputPath, enhancedOutput = t.TempDir(), t.TempDir(), nil
+	outbox = openOutbox(filepath.Join(syncPath, "outbox"))
+	queued, unused := filepath.Join(outputPath, "tmp-a.epub"), filepath.Join(outputPath, "tmp-b.epub")
+	for _, path := range []string{queued, unused} {
+		if err := os.WriteFile(path, []byte("epub"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := outbox.Add("kindle@example.com", "a", "", queued, "a.epub"); err != nil {
+		t.Fatal(err)
+	}
+
+	cleanTmpFiles()
+	if _, err := os.Stat(queued); err != nil {
+		t.Errorf("attachment of queued mail was removed: %v", err)
+	}
+	if _, err := os.Stat(unused); !os.IsNotExist(err) {
+		t.Errorf("unused tmp file was not removed: %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 导出的文件已存在时的处理方式：overwrite 覆盖、suffix 加上序号另存、skip 跳过
+var onConflict string
+
+func validConflictPolicy(policy string) bool {
+	switch policy {
+	case "overwrite", "suffix", "skip":
+		return true
+	}
+	return false
+}
+
+// 一个导出目标的结果，status 为 created、overwritten、renamed、skipped 或 failed
+type outputResult struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// 按 policy 决定实际写入的位置和结果，ext 为加序号时需要保留的扩展名
+func resolveTarget(target, ext, policy string) (string, string, error) {
+	_, err := os.Lstat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return target, "created", nil
+	} else if err != nil {
+		return target, "failed", err
+	}
+	switch policy {
+	case "skip":
+		return target, "skipped", nil
+	case "suffix":
+		base := strings.TrimSuffix(target, ext)
+		for i := 1; ; i++ {
+			next := fmt.Sprintf("%s (%d)%s", base, i, ext)
+			_, err := os.Lstat(next)
+			if errors.Is(err, os.ErrNotExist) {
+				return next, "renamed", nil
+			} else if err != nil {
+				return next, "failed", err
+			}
+		}
+	default:
+		return target, "overwritten", nil
+	}
+}
+
+// 按 onConflict 在 path 下写入 name（会经过 safeJoin 处理，自动创建子目录），write 为实际的写入操作；
+// owned 不为 nil 时写入的是文件夹，只有 owned 确认是本工具导出的文件夹才会删除后覆盖，否则加上序号另存
+func writeOutput(path, name, ext string, owned func(dir string) bool, write func(target string) error) outputResult {
+	target, err := safeJoin(path, name)
+	if err != nil {
+		log.Println(err)
+		return outputResult{Path: filepath.Join(path, name), Status: "failed", Error: err.Error()}
+	}
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		log.Println(err)
+		return outputResult{Path: target, Status: "failed", Error: err.Error()}
+	}
+	target, status, err := resolveTarget(target, ext, onConflict)
+	if err == nil && status == "overwritten" && owned != nil {
+		if owned(target) {
+			err = removeBundle(target)
+		} else {
+			log.Println("不是导出的文件夹，不会覆盖：", target)
+			target, status, err = resolveTarget(target, ext, "suffix")
+		}
+	}
+	if err == nil && status != "skipped" {
+		err = write(target)
+	}
+	result := outputResult{Path: target, Status: status}
+	if err != nil {
+		log.Println(err)
+		result.Status = "failed"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// 出错时返回的错误类型
+const (
+	errorBadRequest  = "bad_request"
+	errorForbidden   = "forbidden"
+	errorNotFound    = "not_found"
+	errorMethod      = "method_not_allowed"
+	errorRead        = "read_failed"
+	errorWrite       = "write_failed"
+	errorPartial     = "partial_failure"
+	errorConvert     = "convert_failed"
+	errorUnavailable = "unavailable"
+	errorTimeout     = "timeout"
+	errorCanceled    = "canceled"
+	errorMail        = "mail_failed"
+	errorProxy       = "proxy_failed"
+	errorInternal    = "internal"
+)
+
+// 本地同步接口统一的返回格式：status 和 code 都是 HTTP 状态码，
+// 出错时 error 为错误类型、message 为原因，导出到多个位置时 outputs 为每个位置的结果
+type syncResult struct {
+	Status  int            `json:"status"`
+	Code    int            `json:"code"`
+	Error   string         `json:"error,omitempty"`
+	Message string         `json:"message,omitempty"`
+	Outputs []outputResult `json:"outputs,omitempty"`
+}
+
+func newSyncResult(status int, errorType, message string) syncResult {
+	return syncResult{Status: status, Code: status, Error: errorType, Message: message}
+}
+
+// 全部位置都失败时为 500，部分失败时为 207，跳过不算失败
+func outputsResult(outputs []outputResult) syncResult {
+	result := newSyncResult(http.StatusOK, "", "")
+	result.Outputs = outputs
+	failed := 0
+	for _, output := range outputs {
+		if output.Status == "failed" {
+			if failed == 0 {
+				result.Message = output.Error
+			}
+			failed++
+		}
+	}
+	if failed > 0 && failed == len(outputs) {
+		result.Status, result.Code, result.Error = http.StatusInternalServerError, http.StatusInternalServerError, errorWrite
+	} else if failed > 0 {
+		result.Status, result.Code, result.Error = http.StatusMultiStatus, http.StatusMultiStatus, errorPartial
+	}
+	return result
+}
+
+// v 为 syncResult 或内嵌了 syncResult 的结构体
+func writeResult(w http.ResponseWriter, status int, v interface{}) {
+	result, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+	_, err = w.Write(result)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, errorType, message string) {
+	w.Header().Set("content-type", "application/json")
+	writeResult(w, status, newSyncResult(status, errorType, message))
+}
+
+// 7027 端口 API 的返回格式：成功时为 {"code":200,"data":...}，出错时为 {"code":404,"message":"..."}，
+// code 与 HTTP 状态码相同；列表类接口在 data 之外还有 total 等分页字段
+type apiResult struct {
+	Code int         `json:"code"`
+	Data interface{} `json:"data"`
+}
+
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeAPIData(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("content-type", "application/json")
+	writeResult(w, code, apiResult{Code: code, Data: data})
+}
+
+func writeAPIError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("content-type", "application/json")
+	writeResult(w, code, apiError{Code: code, Message: message})
+}
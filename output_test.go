@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteOutput(t *testing.T) {
+	defer func(policy, path string) { onConflict, syncPath = policy, path }(onConflict, syncPath)
+	syncPath = t.TempDir()
+	dir := t.TempDir()
+	writeFile := func(content string) func(target string) error {
+		return func(target string) error {
+			return os.WriteFile(target, []byte(content), 0644)
+		}
+	}
+	check := func(result outputResult, path, status, content string) {
+		t.Helper()
+		if result.Path != filepath.Join(dir, path) || result.Status != status {
+			t.Errorf("writeOutput = %s %s, want %s %s", result.Path, result.Status, path, status)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, path)); string(data) != content {
+			t.Errorf("%s = %q, want %q", path, data, content)
+		}
+	}
+
+	onConflict = "overwrite"
+	check(writeOutput(dir, "a.md", ".md", nil, writeFile("1")), "a.md", "created", "1")
+	check(writeOutput(dir, "a.md", ".md", nil, writeFile("2")), "a.md", "overwritten", "2")
+	onConflict = "skip"
+	check(writeOutput(dir, "a.md", ".md", nil, writeFile("3")), "a.md", "skipped", "2")
+	onConflict = "suffix"
+	check(writeOutput(dir, "a.md", ".md", nil, writeFile("4")), "a (1).md", "renamed", "4")
+	check(writeOutput(dir, "a.md", ".md", nil, writeFile("5")), "a (2).md", "renamed", "5")
+	check(writeOutput(dir, "2024/b.md", ".md", nil, writeFile("6")), "2024/b.md", "created", "6")
+
+	if result := writeOutput(dir, "c.md", ".md", nil, func(string) error { return os.ErrPermission }); result.Status != "failed" || result.Error == "" {
+		t.Errorf("failed write = %+v", result)
+	}
+
+	// 文件夹只有确认是导出的才会删除后覆盖
+	onConflict = "overwrite"
+	writeDir := func(target string) error {
+		if err := os.Mkdir(target, 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(target, "text.markdown"), []byte("new"), 0644)
+	}
+	owned := func(string) bool { return true }
+	notOwned := func(string) bool { return false }
+	if err := os.MkdirAll(filepath.Join(dir, "d.textbundle"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "d.textbundle", "old"), []byte("old"), 0644)
+	result := writeOutput(dir, "d.textbundle", ".textbundle", owned, writeDir)
+	if result.Path != filepath.Join(dir, "d.textbundle") || result.Status != "overwritten" {
+		t.Errorf("writeOutput over exported folder = %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d.textbundle", "old")); !os.IsNotExist(err) {
+		t.Errorf("overwritten bundle still has old files: %v", err)
+	}
+	result = writeOutput(dir, "d.textbundle", ".textbundle", notOwned, writeDir)
+	if result.Path != filepath.Join(dir, "d (1).textbundle") || result.Status != "renamed" {
+		t.Errorf("writeOutput over foreign folder = %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d.textbundle", "text.markdown")); err != nil {
+		t.Errorf("foreign folder was changed: %v", err)
+	}
+}
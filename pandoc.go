@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 按输出格式配置的 pandoc 调用方式，只能在配置文件中设置，例如
+//
+//	"converters": {
+//	  "docx": {"args": ["--reference-doc", "/data/reference.docx"], "metadata": {"title": "{{title}}"}}
+//	}
+type converter struct {
+	Bin      string            `mapstructure:"bin"`      // 为空时自动查找 pandoc
+	Args     []string          `mapstructure:"args"`     // 放在输入文件之前的参数
+	Template string            `mapstructure:"template"` // 对应 --template
+	Metadata map[string]string `mapstructure:"metadata"` // 对应 --metadata，值可以使用 {{title}} 等字段
+}
+
+var converters map[string]converter
+
+var matchFormat = regexp.MustCompile(`^[a-z0-9_+-]+$`)
+
+var errPandocNotFound = errors.New("没有找到 pandoc")
+
+func (c converter) validate(format string) error {
+	if !matchFormat.MatchString(format) {
+		return fmt.Errorf("invalid format: %q", format)
+	}
+	if c.Bin != "" {
+		if _, err := exec.LookPath(c.Bin); err != nil {
+			return err
+		}
+	}
+	for _, arg := range c.Args {
+		// 输出位置由 simpread-sync 决定
+		if arg == "-o" || arg == "--output" || strings.HasPrefix(arg, "--output=") ||
+			strings.HasPrefix(arg, "-o") && !strings.HasPrefix(arg, "--") {
+			return fmt.Errorf("args 中不能指定输出文件：%q", arg)
+		}
+	}
+	if c.Template != "" {
+		if _, err := os.Stat(c.Template); err != nil {
+			return err
+		}
+	}
+	for key, value := range c.Metadata {
+		if key == "" || strings.ContainsAny(key, "=:") {
+			return fmt.Errorf("invalid metadata key: %q", key)
+		}
+		if err := validateTemplate(value, "idx", "title", "url", "domain", "date", "tags"); err != nil {
+			return fmt.Errorf("metadata %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// 未配置 bin 时依次查找 PATH 和 Homebrew 的默认安装位置（Apple Silicon 为 /opt/homebrew）
+func (c converter) pandoc() (string, error) {
+	if c.Bin != "" {
+		return exec.LookPath(c.Bin)
+	}
+	if path, err := exec.LookPath("pandoc"); err == nil {
+		return path, nil
+	}
+	for _, path := range []string{"/opt/homebrew/bin/pandoc", "/usr/local/bin/pandoc"} {
+		if path, err := exec.LookPath(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errPandocNotFound
+}
+
+// 配置的参数加上模板和按 fields 生成的元数据，元数据按名称排序
+func (c converter) args(fields *nameFields) []string {
+	args := append([]string{}, c.Args...)
+	if c.Template != "" {
+		args = append(args, "--template", c.Template)
+	}
+	keys := make([]string, 0, len(c.Metadata))
+	for key := range c.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "--metadata", key+"="+fields.expand(c.Metadata[key]))
+	}
+	return args
+}
+
+// 在临时目录中运行 pandoc，输入输出格式由文件扩展名决定，输出写入 logs
+func runPandoc(ctx context.Context, pandoc string, args []string, in, out, content string, logs io.Writer) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "simpread-pandoc-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "in."+in)
+	output := filepath.Join(dir, "out."+out)
+	err = os.WriteFile(input, []byte(content), 0600)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, pandoc, append(args, input, "-o", output)...)
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+	cmd.WaitDelay = time.Second
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("pandoc 运行失败：%w", err)
+	}
+	return os.ReadFile(output)
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/go-pdf/fpdf"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	pdfBackend string // wkhtmltopdf 或 native
+	fontDir    string
+)
+
+func validPDFBackend(backend string) bool {
+	return backend == "wkhtmltopdf" || backend == "native"
+}
+
+// fontDir 中找到的字体文件，没有找到时使用 PDF 内置字体（只支持西文）
+type pdfFonts struct {
+	regular string
+	bold    string
+	mono    string
+}
+
+// 字体目录默认为 syncPath 下的 fonts 文件夹
+func fontDirPath() string {
+	if fontDir != "" {
+		return fontDir
+	}
+	return filepath.Join(syncPath, "fonts")
+}
+
+// 只支持 TrueType 轮廓的 .ttf/.otf，CFF 轮廓的 .otf 和 .ttc 字体集无法嵌入
+func isTrueTypeFont(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var magic uint32
+	if err := binary.Read(f, binary.BigEndian, &magic); err != nil {
+		return false
+	}
+	return magic == 0x00010000 || magic == 0x74727565 // "true"
+}
+
+func findFonts(dir string) pdfFonts {
+	var fonts pdfFonts
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		return fonts
+	}
+	var files []string
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".ttf" && ext != ".otf") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if !isTrueTypeFont(path) {
+			log.Println("跳过不支持的字体：", path)
+			continue
+		}
+		files = append(files, path)
+	}
+	sort.Strings(files)
+
+	for _, path := range files {
+		name := strings.ToLower(filepath.Base(path))
+		isMono := strings.Contains(name, "mono") || strings.Contains(name, "code")
+		isBold := strings.Contains(name, "bold")
+		isItalic := strings.Contains(name, "italic") || strings.Contains(name, "oblique")
+		switch {
+		case isItalic:
+		case isMono:
+			if fonts.mono == "" || !isBold {
+				fonts.mono = path
+			}
+		case isBold:
+			if fonts.bold == "" {
+				fonts.bold = path
+			}
+		case fonts.regular == "" || strings.Contains(name, "regular"):
+			fonts.regular = path
+		}
+	}
+	return fonts
+}
+
+// 将 HTML 渲染为 PDF，支持标题、段落、列表、引用、代码块、链接和图片
+type pdfRenderer struct {
+	ctx    context.Context
+	pdf    *fpdf.Fpdf
+	fonts  pdfFonts
+	tr     func(string) string
+	base   *neturl.URL
+	margin float64
+
+	bold   int
+	italic int
+	mono   int
+	size   float64
+	link   string
+	lists  []int // 有序列表的当前序号，无序列表为 -1
+	quotes int
+	images int
+	space  bool // 上一个输出的字符是否为空白
+}
+
+// ctx 结束后不再下载图片并返回错误
+func renderNativePDF(ctx context.Context, title, content, base string) ([]byte, error) {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(20, 20, 20)
+	pdf.SetAutoPageBreak(true, 20)
+	pdf.SetTitle(title, true)
+	pdf.SetCreator("simpread-sync", true)
+
+	r := &pdfRenderer{ctx: ctx, pdf: pdf, fonts: findFonts(fontDirPath()), margin: 20, size: 11, tr: func(s string) string { return s }}
+	if r.fonts.regular != "" {
+		err := r.addFont("body", "", r.fonts.regular)
+		if err == nil && r.fonts.bold != "" {
+			err = r.addFont("body", "B", r.fonts.bold)
+		}
+		if err == nil && r.fonts.mono != "" {
+			err = r.addFont("mono", "", r.fonts.mono)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Println("fontDir 中没有可用的字体，PDF 中只能显示西文")
+		r.tr = pdf.UnicodeTranslatorFromDescriptor("")
+	}
+	if u, err := neturl.Parse(base); err == nil && u.Scheme != "" {
+		r.base = u
+	}
+
+	doc, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	pdf.AddPage()
+	r.setFont()
+	r.walk(doc)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = pdf.Output(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *pdfRenderer) addFont(family, style, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	r.pdf.AddUTF8FontFromBytes(family, style, data)
+	if r.pdf.Err() {
+		return fmt.Errorf("%s: %w", path, r.pdf.Error())
+	}
+	return nil
+}
+
+func (r *pdfRenderer) setFont() {
+	family, style := "body", ""
+	if r.fonts.regular == "" {
+		family = "Helvetica"
+		if r.italic > 0 {
+			style += "I"
+		}
+	}
+	if r.bold > 0 && (r.fonts.regular == "" || r.fonts.bold != "") {
+		style = "B" + style
+	}
+	if r.mono > 0 {
+		switch {
+		case r.fonts.mono != "":
+			family, style = "mono", ""
+		case r.fonts.regular == "":
+			family = "Courier"
+		}
+	}
+	r.pdf.SetFont(family, style, r.size)
+	switch {
+	case r.link != "":
+		r.pdf.SetTextColor(30, 90, 200)
+	case r.quotes > 0:
+		r.pdf.SetTextColor(100, 100, 100)
+	default:
+		r.pdf.SetTextColor(0, 0, 0)
+	}
+}
+
+func (r *pdfRenderer) lineHeight() float64 {
+	return r.size * 0.5
+}
+
+func (r *pdfRenderer) indent() float64 {
+	return r.margin + float64(len(r.lists)+r.quotes)*6
+}
+
+// 结束当前行并留出 gap 的间距
+func (r *pdfRenderer) block(gap float64) {
+	left, _, _, _ := r.pdf.GetMargins()
+	if r.pdf.GetX() > left+0.1 {
+		r.pdf.Ln(r.lineHeight())
+	}
+	if gap > 0 && r.pdf.GetY() > r.margin+0.1 {
+		r.pdf.Ln(gap)
+	}
+	r.pdf.SetLeftMargin(r.indent())
+	r.pdf.SetX(r.indent())
+	r.space = true
+}
+
+func (r *pdfRenderer) text(s string) {
+	// 合并连续的空白，行首不输出空白
+	var b strings.Builder
+	for _, c := range s {
+		if unicode.IsSpace(c) {
+			if !r.space {
+				b.WriteByte(' ')
+				r.space = true
+			}
+			continue
+		}
+		b.WriteRune(c)
+		r.space = false
+	}
+	if b.Len() == 0 {
+		return
+	}
+	if r.link != "" {
+		r.pdf.WriteLinkString(r.lineHeight(), r.tr(b.String()), r.link)
+	} else {
+		r.pdf.Write(r.lineHeight(), r.tr(b.String()))
+	}
+}
+
+func (r *pdfRenderer) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.walk(c)
+	}
+}
+
+func (r *pdfRenderer) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.text(n.Data)
+		return
+	case html.DocumentNode:
+		r.children(n)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Noscript, atom.Template, atom.Iframe, atom.Svg:
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level := int(n.Data[1] - '0')
+		sizes := []float64{22, 18, 15, 13, 12, 11}
+		r.block(r.lineHeight())
+		r.pdf.Bookmark(r.tr(strings.TrimSpace(textContent(n))), level-1, -1)
+		size := r.size
+		r.size = sizes[level-1]
+		r.bold++
+		r.setFont()
+		r.children(n)
+		r.bold--
+		r.size = size
+		r.setFont()
+		r.block(2)
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Figure, atom.Figcaption, atom.Dl, atom.Dt, atom.Dd, atom.Table, atom.Tr:
+		r.block(2)
+		r.children(n)
+		r.block(0)
+	case atom.Td, atom.Th:
+		r.children(n)
+		r.text(" ")
+	case atom.Br:
+		r.pdf.Ln(r.lineHeight())
+		r.space = true
+	case atom.Hr:
+		r.block(2)
+		y := r.pdf.GetY()
+		w, _ := r.pdf.GetPageSize()
+		r.pdf.SetDrawColor(200, 200, 200)
+		r.pdf.Line(r.indent(), y, w-r.margin, y)
+		r.block(2)
+	case atom.Ul, atom.Ol:
+		start := -1
+		if n.DataAtom == atom.Ol {
+			start = 1
+			if v, err := strconv.Atoi(attr(n, "start")); err == nil {
+				start = v
+			}
+		}
+		r.block(1)
+		r.lists = append(r.lists, start)
+		r.children(n)
+		r.lists = r.lists[:len(r.lists)-1]
+		r.block(1)
+	case atom.Li:
+		r.block(0)
+		marker := "•"
+		if len(r.lists) > 0 && r.lists[len(r.lists)-1] >= 0 {
+			marker = fmt.Sprint(r.lists[len(r.lists)-1], ".")
+			r.lists[len(r.lists)-1]++
+		} else if r.fonts.regular == "" {
+			marker = "-"
+		}
+		r.pdf.SetX(r.indent() - 5)
+		r.pdf.Write(r.lineHeight(), r.tr(marker))
+		r.pdf.SetX(r.indent())
+		r.children(n)
+		r.block(0)
+	case atom.Blockquote:
+		r.block(2)
+		r.quotes++
+		r.setFont()
+		r.block(0)
+		r.children(n)
+		r.quotes--
+		r.setFont()
+		r.block(2)
+	case atom.Pre:
+		r.block(2)
+		r.mono++
+		r.setFont()
+		r.pdf.SetFillColor(245, 245, 245)
+		code := strings.TrimRight(strings.ReplaceAll(textContent(n), "\t", "    "), "\n")
+		w, _ := r.pdf.GetPageSize()
+		r.pdf.MultiCell(w-r.margin-r.indent(), r.lineHeight(), r.tr(code), "", "L", true)
+		r.mono--
+		r.setFont()
+		r.block(2)
+	case atom.Code, atom.Kbd, atom.Samp, atom.Tt:
+		r.mono++
+		r.setFont()
+		r.children(n)
+		r.mono--
+		r.setFont()
+	case atom.B, atom.Strong:
+		r.bold++
+		r.setFont()
+		r.children(n)
+		r.bold--
+		r.setFont()
+	case atom.I, atom.Em, atom.Cite:
+		r.italic++
+		r.setFont()
+		r.children(n)
+		r.italic--
+		r.setFont()
+	case atom.A:
+		link := r.link
+		if href := resolveImageURL(attr(n, "href"), r.base); href != "" && !strings.HasPrefix(href, "data:") {
+			r.link = href
+		}
+		r.setFont()
+		r.children(n)
+		r.link = link
+		r.setFont()
+	case atom.Img:
+		r.image(n)
+	default:
+		r.children(n)
+	}
+}
+
+// 支持 jpg、png 和 gif，其他格式或下载失败时输出 alt
+func (r *pdfRenderer) image(n *html.Node) {
+	src := resolveImageURL(attr(n, "src"), r.base)
+	var body []byte
+	var contentType string
+	var err error
+	switch {
+	case src == "":
+		err = fmt.Errorf("unsupported image: %q", attr(n, "src"))
+	case strings.HasPrefix(src, "data:"):
+		body, contentType, err = decodeDataURI(src)
+	case r.ctx.Err() != nil:
+		err = r.ctx.Err()
+	default:
+		body, contentType, err = fetchImage(r.ctx, src)
+	}
+	var imageType string
+	if err == nil {
+		switch imageExtension(body, contentType, src) {
+		case ".jpg":
+			imageType = "JPG"
+		case ".png":
+			imageType = "PNG"
+		case ".gif":
+			imageType = "GIF"
+		default:
+			err = fmt.Errorf("unsupported image type: %s", shortenURL(src))
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		if alt := attr(n, "alt"); alt != "" {
+			r.text("[" + alt + "]")
+		}
+		return
+	}
+
+	r.images++
+	name := fmt.Sprint("img", r.images)
+	options := fpdf.ImageOptions{ImageType: imageType, ReadDpi: true}
+	info := r.pdf.RegisterImageOptionsReader(name, options, bytes.NewReader(body))
+	if r.pdf.Err() {
+		log.Println(r.pdf.Error())
+		r.pdf.ClearError()
+		return
+	}
+	pageW, pageH := r.pdf.GetPageSize()
+	maxW, maxH := pageW-r.margin-r.indent(), pageH-2*r.margin
+	w, h := info.Extent()
+	if w > maxW {
+		w, h = maxW, h*maxW/w
+	}
+	if h > maxH {
+		w, h = w*maxH/h, maxH
+	}
+	r.block(2)
+	r.pdf.ImageOptions(name, r.indent(), -1, w, h, true, options, 0, "")
+	r.block(2)
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Br {
+			b.WriteByte('\n')
+			continue
+		}
+		b.WriteString(textContent(c))
+	}
+	return b.String()
+}
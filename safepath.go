@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	transliterate bool
+	maxNameLength int
+)
+
+var errOutsideRoots = errors.New("路径不在允许的导出目录中")
+
+// 去掉变音符号后仍不是 ASCII 的常见拉丁字母
+var transliterations = map[rune]string{
+	'ß': "ss", 'Æ': "AE", 'æ': "ae", 'Ø': "O", 'ø': "o", 'Œ': "OE", 'œ': "oe",
+	'Đ': "D", 'đ': "d", 'Ł': "L", 'ł': "l", 'Þ': "Th", 'þ': "th", 'Ð': "D", 'ð': "d",
+	'“': "\"", '”': "\"", '‘': "'", '’': "'", '–': "-", '—': "-", '…': "...",
+}
+
+// Windows 下不能作为文件名的设备名
+var reservedNames = map[string]struct{}{
+	"CON": {}, "PRN": {}, "AUX": {}, "NUL": {},
+	"COM1": {}, "COM2": {}, "COM3": {}, "COM4": {}, "COM5": {}, "COM6": {}, "COM7": {}, "COM8": {}, "COM9": {},
+	"LPT1": {}, "LPT2": {}, "LPT3": {}, "LPT4": {}, "LPT5": {}, "LPT6": {}, "LPT7": {}, "LPT8": {}, "LPT9": {},
+}
+
+// 把客户端传来的标题转换为可以在各个文件系统上使用的单个文件名：
+// 替换路径分隔符、保留字符和控制字符，去掉首尾的空格和点，
+// transliterate 为 true 时去掉变音符号，超过 maxNameLength 字节时截断并保留扩展名
+func safeName(name string) string {
+	name = norm.NFC.String(name)
+	if transliterate {
+		var b strings.Builder
+		for _, r := range norm.NFKD.String(name) {
+			if unicode.Is(unicode.Mn, r) {
+				continue
+			}
+			if s, ok := transliterations[r]; ok {
+				b.WriteString(s)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+		name = norm.NFC.String(b.String())
+	}
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsSpace(r):
+			return ' '
+		case r == utf8.RuneError, unicode.IsControl(r):
+			return -1
+		case strings.ContainsRune(`/\<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if len(ext) > 16 || strings.ContainsRune(ext, ' ') {
+		base, ext = name, ""
+	}
+	if _, ok := reservedNames[strings.ToUpper(base)]; ok {
+		base = "_" + base
+	}
+	if base == "" {
+		base = "untitled"
+	}
+	if maxNameLength > 0 && len(base)+len(ext) > maxNameLength {
+		n := maxNameLength - len(ext)
+		if n < 1 {
+			n = 1
+		}
+		for n > 0 && n < len(base) && !utf8.RuneStart(base[n]) {
+			n--
+		}
+		base = strings.TrimRight(base[:n], " .")
+	}
+	return base + ext
+}
+
+// 客户端可以指定的导出目录：outputPath 和 enhancedOutput 中配置的目录，
+// syncPath 中保存着历史版本、任务等数据，不允许写入
+func outputRoots() []string {
+	roots := []string{outputPath}
+	for _, i := range enhancedOutput {
+		path := i["path"]
+		if path == "" {
+			path = filepath.Join(outputPath, i["extension"])
+		}
+		roots = append(roots, path)
+	}
+	return roots
+}
+
+// path 是否位于 outputRoots 中的某个目录下
+func withinRoots(path string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for _, root := range outputRoots() {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 在 dir 下为 name 生成安全的路径，name 为 outputTarget.name 的结果，只有模板生成的 / 表示子目录，
+// 每一级分别经过 safeName 处理；结果不在 dir 下时返回错误
+func safeJoin(dir, name string) (string, error) {
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, safeName(part))
+		}
+	}
+	if len(parts) == 0 {
+		parts = append(parts, safeName(""))
+	}
+	target := filepath.Join(append([]string{dir}, parts...)...)
+	rel, err := filepath.Rel(dir, target)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errOutsideRoots
+	}
+	return target, nil
+}
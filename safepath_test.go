@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSafeName(t *testing.T) {
+	defer func(t bool, n int) { transliterate, maxNameLength = t, n }(transliterate, maxNameLength)
+	tests := []struct {
+		name          string
+		transliterate bool
+		maxLength     int
+		want          string
+	}{
+		{"标题.md", false, 200, "标题.md"},
+		{"a/b\\c:d*e?.html", false, 200, "a_b_c_d_e_.html"},
+		{"<x>|\"y\"", false, 200, "_x___y_"},
+		{"  .hidden. ", false, 200, "hidden"},
+		{"a\tb\nc\x00d", false, 200, "a b cd"},
+		{"..", false, 200, "untitled"},
+		{"", false, 200, "untitled"},
+		{"con.md", false, 200, "_con.md"},
+		{"Nul", false, 200, "_Nul"},
+		{"é", false, 200, "é"},
+		{"Ærøskøbing Straße café", true, 200, "AEroskobing Strasse cafe"},
+		{"“引号” – b", true, 200, "_引号_ - b"},
+		{"abcdefgh.md", false, 6, "abc.md"},
+		{"中文标题.md", false, 10, "中文.md"},
+		{"a b.c d", false, 200, "a b.c d"},
+		{"x." + strings.Repeat("e", 20), false, 10, "x.eeeeeeee"},
+	}
+	for _, tt := range tests {
+		transliterate, maxNameLength = tt.transliterate, tt.maxLength
+		if got := safeName(tt.name); got != tt.want {
+			t.Errorf("safeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	dir := filepath.Join("out", "put")
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"a.md", "a.md"},
+		{"2024/10/a.md", "2024/10/a.md"},
+		{"../../a.md", "untitled/untitled/a.md"},
+		{" / a / ", "a"},
+		{"", "untitled"},
+		{"x\\y.md", "x_y.md"},
+	}
+	for _, tt := range tests {
+		got, err := safeJoin(dir, tt.name)
+		if want := filepath.Join(dir, filepath.FromSlash(tt.want)); err != nil || got != want {
+			t.Errorf("safeJoin(%q) = %q, %v, want %q", tt.name, got, err, want)
+		}
+	}
+}
+
+func TestWithinRoots(t *testing.T) {
+	defer func(o string, e []map[string]string) { outputPath, enhancedOutput = o, e }(outputPath, enhancedOutput)
+	root := t.TempDir()
+	outputPath = filepath.Join(root, "output")
+	enhancedOutput = []map[string]string{{"extension": "pdf"}, {"extension": "epub", "path": filepath.Join(root, "books")}}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{outputPath, true},
+		{filepath.Join(outputPath, "pdf", "a.pdf"), true},
+		{filepath.Join(root, "books", "2024"), true},
+		{filepath.Join(root, "output2"), false},
+		{filepath.Join(outputPath, "..", "jobs"), false},
+		{root, false},
+	}
+	for _, tt := range tests {
+		if got := withinRoots(tt.path); got != tt.want {
+			t.Errorf("withinRoots(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
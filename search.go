@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/spf13/cobra"
+)
+
+// 导出文章的全文索引，保存在 syncPath 下的 search.index，以文件路径为键，只保存词频和长度，
+// 摘要在查询时从文件中读取；中日韩文字按单字和二元组切分，其余按单词切分并转为小写
+type searchIndex struct {
+	mu       sync.RWMutex
+	path     string
+	Docs     map[string]*searchDoc
+	postings map[string]map[string]int // 由 Docs 生成，不保存
+	dirty    bool
+	timer    *time.Timer
+}
+
+// Name 为 /reading/ 使用的文件名
+type searchDoc struct {
+	Name    string
+	Title   string
+	ModTime time.Time
+	Length  int
+	Freq    map[string]int
+}
+
+type searchHit struct {
+	File    string  `json:"file"`
+	Path    string  `json:"path"`
+	Idx     int     `json:"idx,omitempty"`
+	Title   string  `json:"title"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+}
+
+var index *searchIndex
+
+// 修改后最多等待这么久再写入磁盘，连续的修改只写入一次
+const searchSaveDelay = 5 * time.Second
+
+func isSearchable(name string) bool {
+	if strings.HasPrefix(name, "tmp-") {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".html", ".htm", ".md", ".markdown", ".txt":
+		return true
+	}
+	return false
+}
+
+func openSearchIndex(path string) *searchIndex {
+	idx := &searchIndex{
+		path:     path,
+		Docs:     map[string]*searchDoc{},
+		postings: map[string]map[string]int{},
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(idx)
+		if err != nil {
+			log.Println("索引文件损坏，重新建立：", err)
+			idx.Docs = map[string]*searchDoc{}
+		}
+	} else if !os.IsNotExist(err) {
+		log.Println(err)
+	}
+	for path, doc := range idx.Docs {
+		// 旧版本的索引没有词频，由 Reconcile 重新索引
+		if doc.Freq == nil {
+			delete(idx.Docs, path)
+			continue
+		}
+		idx.post(path, doc)
+	}
+	return idx
+}
+
+func (idx *searchIndex) save() error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(idx)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(idx.path, buf.Bytes(), 0644)
+}
+
+// 调用时需持有写锁，searchSaveDelay 后写入磁盘
+func (idx *searchIndex) changed() {
+	idx.dirty = true
+	if idx.timer == nil {
+		idx.timer = time.AfterFunc(searchSaveDelay, idx.Flush)
+	}
+}
+
+// 写入尚未保存的修改
+func (idx *searchIndex) Flush() {
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.timer != nil {
+		idx.timer.Stop()
+		idx.timer = nil
+	}
+	if !idx.dirty {
+		return
+	}
+	if err := idx.save(); err != nil {
+		log.Println(err)
+		return
+	}
+	idx.dirty = false
+}
+
+// 需要索引的文件及其名称：outputPath 和 enhancedOutput 目录下的文件，以及按模板导出的文件
+func searchSources() map[string]string {
+	sources := map[string]string{}
+	dirs := []string{outputPath}
+	for _, i := range enhancedOutput {
+		if i["template"] != "" {
+			continue
+		}
+		path := i["path"]
+		if path == "" {
+			path = filepath.Join(outputPath, i["extension"])
+		}
+		dirs = append(dirs, path)
+	}
+	for _, dir := range dirs {
+		fileInfo, err := os.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Println(err)
+			}
+			continue
+		}
+		for _, file := range fileInfo {
+			if !file.IsDir() && isSearchable(file.Name()) {
+				sources[filepath.Join(dir, file.Name())] = file.Name()
+			}
+		}
+	}
+	for _, name := range names.Names() {
+		if path := names.Lookup(name); path != "" && isSearchable(path) {
+			sources[path] = name
+		}
+	}
+	return sources
+}
+
+// 同步 sources 中的文件：新增和修改过的文件重新索引，不存在的文件从索引中移除
+func (idx *searchIndex) Reconcile(sources map[string]string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	changed := false
+	for path, name := range sources {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if doc, ok := idx.Docs[path]; ok && doc.Name == name && doc.ModTime.Equal(info.ModTime()) {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		idx.add(path, name, content, info.ModTime())
+		changed = true
+	}
+	for path := range idx.Docs {
+		if _, ok := sources[path]; !ok {
+			idx.remove(path)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	idx.dirty = false
+	return idx.save()
+}
+
+// 索引刚写入的文件 path，name 为 /reading/ 使用的文件名
+func (idx *searchIndex) Add(path, name string) {
+	if idx == nil || !isSearchable(path) {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.add(path, name, content, info.ModTime())
+	idx.changed()
+}
+
+func (idx *searchIndex) Remove(path string) {
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if _, ok := idx.Docs[path]; !ok {
+		return
+	}
+	idx.remove(path)
+	idx.changed()
+}
+
+func (idx *searchIndex) add(path, name string, content []byte, modTime time.Time) {
+	idx.remove(path)
+	title, text := extractText(name, content)
+	terms := tokenize(title + "\n" + text)
+	freq := map[string]int{}
+	for _, term := range terms {
+		freq[term]++
+	}
+	doc := &searchDoc{
+		Name:    name,
+		Title:   title,
+		ModTime: modTime,
+		Length:  len(terms),
+		Freq:    freq,
+	}
+	idx.Docs[path] = doc
+	idx.post(path, doc)
+}
+
+func (idx *searchIndex) post(path string, doc *searchDoc) {
+	for term, n := range doc.Freq {
+		if idx.postings[term] == nil {
+			idx.postings[term] = map[string]int{}
+		}
+		idx.postings[term][path] = n
+	}
+}
+
+func (idx *searchIndex) remove(path string) {
+	doc, ok := idx.Docs[path]
+	if !ok {
+		return
+	}
+	for term := range doc.Freq {
+		if postings := idx.postings[term]; postings != nil {
+			delete(postings, path)
+			if len(postings) == 0 {
+				delete(idx.postings, term)
+			}
+		}
+	}
+	delete(idx.Docs, path)
+}
+
+// BM25 排序，返回当前页的结果和命中总数
+func (idx *searchIndex) Search(query string, offset, limit int) ([]searchHit, int) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	terms := uniqueTerms(tokenize(query))
+	if len(terms) == 0 || len(idx.Docs) == 0 {
+		return []searchHit{}, 0
+	}
+	var avgLength float64
+	for _, doc := range idx.Docs {
+		avgLength += float64(doc.Length)
+	}
+	avgLength /= float64(len(idx.Docs))
+
+	const k1, b = 1.2, 0.75
+	scores := map[string]float64{}
+	for _, term := range terms {
+		postings := idx.postings[term]
+		if len(postings) == 0 {
+			continue
+		}
+		idf := math.Log(1 + (float64(len(idx.Docs))-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+		for path, tf := range postings {
+			length := float64(idx.Docs[path].Length)
+			scores[path] += idf * float64(tf) * (k1 + 1) / (float64(tf) + k1*(1-b+b*length/avgLength))
+		}
+	}
+
+	hits := make([]searchHit, 0, len(scores))
+	for path, score := range scores {
+		hits = append(hits, searchHit{File: idx.Docs[path].Name, Path: path, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Path < hits[j].Path
+	})
+
+	total := len(hits)
+	if offset >= total {
+		return []searchHit{}, total
+	}
+	hits = hits[offset:]
+	if limit > 0 && limit < len(hits) {
+		hits = hits[:limit]
+	}
+	for i := range hits {
+		hits[i].Title = idx.Docs[hits[i].Path].Title
+		// 全文不保存在索引中，只读取当前页的文件生成摘要
+		if content, err := os.ReadFile(hits[i].Path); err == nil {
+			_, text := extractText(hits[i].File, content)
+			hits[i].Snippet = snippet(text, query, terms)
+		}
+		if n := strings.Index(hits[i].File, "-"); n > 0 {
+			hits[i].Idx, _ = strconv.Atoi(hits[i].File[:n])
+		}
+	}
+	return hits, total
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+func tokenize(s string) []string {
+	var terms []string
+	var word []rune
+	var cjk []rune
+	flushWord := func() {
+		if len(word) > 0 {
+			terms = append(terms, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	flushCJK := func() {
+		for i := range cjk {
+			terms = append(terms, string(cjk[i]))
+			if i+1 < len(cjk) {
+				terms = append(terms, string(cjk[i:i+2]))
+			}
+		}
+		cjk = cjk[:0]
+	}
+	for _, r := range s {
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+	return terms
+}
+
+// 查询中的中日韩文字只保留二元组，单字仅在无法组成二元组时使用
+func uniqueTerms(terms []string) []string {
+	seen := map[string]struct{}{}
+	var unique []string
+	for i, term := range terms {
+		if utf8.RuneCountInString(term) == 1 && isCJK([]rune(term)[0]) {
+			prevBigram := i > 0 && utf8.RuneCountInString(terms[i-1]) == 2 && strings.HasSuffix(terms[i-1], term)
+			nextBigram := i+1 < len(terms) && utf8.RuneCountInString(terms[i+1]) == 2 && strings.HasPrefix(terms[i+1], term)
+			if prevBigram || nextBigram {
+				continue
+			}
+		}
+		if _, ok := seen[term]; !ok {
+			seen[term] = struct{}{}
+			unique = append(unique, term)
+		}
+	}
+	return unique
+}
+
+func snippet(text, query string, terms []string) string {
+	const width = 60
+	runes := []rune(text)
+	lower := strings.ToLower(text)
+	pos := strings.Index(lower, strings.ToLower(strings.TrimSpace(query)))
+	for _, term := range terms {
+		if pos >= 0 {
+			break
+		}
+		pos = strings.Index(lower, term)
+	}
+	start := 0
+	if pos > 0 {
+		start = utf8.RuneCountInString(lower[:pos]) - width/2
+	}
+	if start < 0 || start > len(runes) {
+		start = 0
+	}
+	end := start + width*2
+	if end > len(runes) {
+		end = len(runes)
+	}
+	s := strings.TrimSpace(string(runes[start:end]))
+	if start > 0 {
+		s = "…" + s
+	}
+	if end < len(runes) {
+		s += "…"
+	}
+	return s
+}
+
+var (
+	matchHTMLTitle    = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	matchHTMLHeading  = regexp.MustCompile(`(?is)<h1[^>]*>(.*?)</h1>`)
+	matchHTMLSkip     = regexp.MustCompile(`(?is)<(script|style|head)[^>]*>.*?</(script|style|head)>`)
+	matchHTMLTag      = regexp.MustCompile(`(?s)<[^>]*>`)
+	matchMarkdownHead = regexp.MustCompile(`(?m)^#\s+(.+)$`)
+	matchMarkdownLink = regexp.MustCompile(`!?\[([^\]]*)\]\([^)]*\)`)
+	matchSpaces       = regexp.MustCompile(`\s+`)
+)
+
+// 返回标题和纯文本
+func extractText(name string, content []byte) (string, string) {
+	s := string(content)
+	var title string
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".html", ".htm":
+		if m := matchHTMLTitle.FindStringSubmatch(s); m != nil {
+			title = m[1]
+		} else if m := matchHTMLHeading.FindStringSubmatch(s); m != nil {
+			title = m[1]
+		}
+		title = html.UnescapeString(matchHTMLTag.ReplaceAllString(title, ""))
+		s = matchHTMLSkip.ReplaceAllString(s, " ")
+		s = html.UnescapeString(matchHTMLTag.ReplaceAllString(s, " "))
+	case ".md", ".markdown":
+		if m := matchMarkdownHead.FindStringSubmatch(s); m != nil {
+			title = m[1]
+		}
+		s = matchMarkdownLink.ReplaceAllString(s, "$1")
+	}
+	title = strings.TrimSpace(matchSpaces.ReplaceAllString(title, " "))
+	if title == "" {
+		title = strings.TrimSuffix(name, filepath.Ext(name))
+		if n := strings.Index(title, "-"); n > 0 {
+			if _, err := strconv.Atoi(title[:n]); err == nil {
+				title = title[n+1:]
+			}
+		}
+	}
+	return title, strings.TrimSpace(matchSpaces.ReplaceAllString(s, " "))
+}
+
+func initSearchIndex() {
+	index = openSearchIndex(filepath.Join(syncPath, "search.index"))
+	if err := index.Reconcile(searchSources()); err != nil {
+		log.Println(err)
+	}
+}
+
+// q 为查询内容，offset/limit 分页，limit 默认 20
+func APIsearchHandle(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	offset, _ := strconv.Atoi(r.Form.Get("offset"))
+	limit, err := strconv.Atoi(r.Form.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	hits, total := index.Search(r.Form.Get("q"), offset, limit)
+	w.Header().Set("content-type", "application/json")
+	writeResult(w, http.StatusOK, struct {
+		Code  int         `json:"code"`
+		Data  []searchHit `json:"data"`
+		Total int         `json:"total"`
+	}{Code: http.StatusOK, Data: hits, Total: total})
+}
+
+var searchLimit int
+
+var searchCmd = &cobra.Command{
+	Use:                "search <query>",
+	Short:              "full-text search exported articles",
+	Args:               cobra.MinimumNArgs(1),
+	FParseErrWhitelist: pathFlagsWhitelist,
+	PreRun:             preRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		initSearchIndex()
+		hits, total := index.Search(strings.Join(args, " "), 0, searchLimit)
+		for _, hit := range hits {
+			fmt.Printf("%.3f\t%s\n\t%s\n", hit.Score, hit.File, hit.Snippet)
+		}
+		fmt.Printf("%d results\n", total)
+	},
+}
+
+func init() {
+	searchCmd.Flags().IntVarP(&searchLimit, "limit", "n", 20, "max results")
+	rootCmd.AddCommand(searchCmd)
+}
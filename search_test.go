@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSearchIndex(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"1-golang.md":  "# Go 语言\n\nGo 是一门编程语言，适合编写服务器程序。",
+		"2-rust.html":  "<html><head><title>Rust 入门</title></head><body><p>Rust 也是一门编程语言。</p><script>go()</script></body></html>",
+		"3-cooking.md": "# 做饭\n\n今天做了红烧肉。",
+		"tmp-x.md":     "编程语言",
+	}
+	sources := map[string]string{}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if isSearchable(name) {
+			sources[path] = name
+		}
+	}
+
+	idx := openSearchIndex(filepath.Join(dir, "search.index"))
+	if err := idx.Reconcile(sources); err != nil {
+		t.Fatal(err)
+	}
+	hits, total := idx.Search("编程语言", 0, 10)
+	if total != 2 || len(hits) != 2 {
+		t.Fatalf("Search = %v, %d", hits, total)
+	}
+	for _, hit := range hits {
+		if hit.File == "1-golang.md" && (hit.Idx != 1 || hit.Title != "Go 语言" || hit.Snippet == "") {
+			t.Errorf("hit = %+v", hit)
+		}
+	}
+	if hits, _ := idx.Search("go", 0, 10); len(hits) != 1 {
+		t.Errorf("script content is indexed: %+v", hits)
+	}
+	if hits, total := idx.Search("编程语言", 1, 10); total != 2 || len(hits) != 1 {
+		t.Errorf("offset: %v, %d", hits, total)
+	}
+
+	// 重新打开后结果不变
+	idx = openSearchIndex(filepath.Join(dir, "search.index"))
+	if _, total := idx.Search("红烧肉", 0, 10); total != 1 {
+		t.Errorf("reopened index: %d results", total)
+	}
+
+	cooking := filepath.Join(dir, "3-cooking.md")
+	idx.Remove(cooking)
+	golang := filepath.Join(dir, "1-golang.md")
+	os.WriteFile(golang, []byte("# Go\n\n红烧肉"), 0644)
+	idx.Add(golang, "1-golang.md")
+	if hits, _ := idx.Search("红烧肉", 0, 10); len(hits) != 1 || hits[0].Path != golang {
+		t.Errorf("after update: %+v", hits)
+	}
+	if _, total := idx.Search("服务器", 0, 10); total != 0 {
+		t.Errorf("old terms still indexed: %d", total)
+	}
+	idx.Flush()
+	idx = openSearchIndex(filepath.Join(dir, "search.index"))
+	if len(idx.Docs) != 2 || idx.Docs[cooking] != nil {
+		t.Errorf("flushed index has %d docs", len(idx.Docs))
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	got := tokenize("Hello, 世界杯!")
+	want := []string{"hello", "世", "世界", "界", "界杯", "杯"}
+	if len(got) != len(want) {
+		t.Fatalf("tokenize = %q, want %q", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("tokenize = %q, want %q", got, want)
+		}
+	}
+	if terms := uniqueTerms(tokenize("世界 世界")); len(terms) != 1 || terms[0] != "世界" {
+		t.Errorf("uniqueTerms = %q", terms)
+	}
+}
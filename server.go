@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	listenAddr      string
+	apiPort         int
+	apiListenAddr   string
+	disableAPI      bool
+	shutdownTimeout time.Duration
+)
+
+// 请求返回后仍在后台运行的任务（如图片下载、转换任务、发送邮件），关闭时会等待其完成
+var jobs sync.WaitGroup
+
+// address 为空时监听所有网卡，以 unix: 开头时监听 unix socket 并忽略 port
+func listen(address string, port int) (net.Listener, error) {
+	if socket := strings.TrimPrefix(address, "unix:"); socket != address {
+		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		ln, err := net.Listen("unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(socket, 0660); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return ln, nil
+	}
+	return net.Listen("tcp", net.JoinHostPort(address, fmt.Sprint(port)))
+}
+
+// tlsConfig 不为 nil 时使用 https，运行中出现的错误发送到 errs
+func startServer(name, address string, port int, tlsConfig *tls.Config, handler http.Handler, errs chan<- error) (*http.Server, error) {
+	ln, err := listen(address, port)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "http"
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+		scheme = "https"
+	}
+	log.Printf("%s 监听 %s (%s)", name, ln.Addr(), scheme)
+	srv := &http.Server{Handler: handler}
+	go func() {
+		err := srv.Serve(ln)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errs <- err
+		}
+	}()
+	return srv, nil
+}
+
+// 停止接受新请求，在 shutdownTimeout 内等待进行中的请求和后台任务完成，全部完成后清理 tmp- 文件
+// 排队中的转换任务和邮件不再开始，下次启动时继续
+func shutdown(servers []*http.Server) {
+	log.Println("正在关闭，最多等待", shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Println(err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+	queue.Close()
+	outbox.Close()
+
+	done := make(chan struct{})
+	go func() {
+		jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		// 超时后仍在运行的任务可能还在写入 tmp- 文件，只在全部完成后清理
+		cleanTmpFiles()
+	case <-ctx.Done():
+		log.Println("等待超时，仍有任务未完成，tmp- 文件留到下次启动时清理")
+	}
+	index.Flush()
+	log.Println("已关闭")
+}
+
+// 排队中或发送失败的邮件的附件在发送成功后由 outbox 删除
+func cleanTmpFiles() {
+	dirs := append([]string{syncPath, outputPath}, getOutputPaths("tmp")...)
+	var attachments map[string]struct{}
+	if outbox != nil {
+		attachments = outbox.Sources()
+	}
+	seen := map[string]struct{}{}
+	for _, dir := range dirs {
+		if _, ok := seen[dir]; ok {
+			continue
+		}
+		seen[dir] = struct{}{}
+		fileInfo, err := os.ReadDir(dir)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, file := range fileInfo {
+			if !file.IsDir() && strings.HasPrefix(file.Name(), "tmp-") {
+				path := filepath.Join(dir, file.Name())
+				if abs, err := filepath.Abs(path); err == nil {
+					if _, ok := attachments[abs]; ok {
+						continue
+					}
+				}
+				err := os.Remove(path)
+				if err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 所有对 simpread_config.json 的读写都经过 store，
+// 写操作串行化并以临时文件 + fsync + rename 的方式原子替换
+type configStore struct {
+	mu   sync.RWMutex
+	path string
+
+	// CachedConfig 缓存的内容及对应文件的修改时间和大小
+	cacheMu   sync.Mutex
+	cache     *Config
+	cacheMod  time.Time
+	cacheSize int64
+}
+
+var store *configStore
+
+func newConfigStore(path string) *configStore {
+	return &configStore{path: path}
+}
+
+func (s *configStore) Load() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return os.ReadFile(s.path)
+}
+
+// fn 在持有写锁的情况下执行，返回的内容会原子写回，被替换的内容存为历史版本
+// 文件不存在时 fn 收到 nil，fn 返回错误时不会写入
+func (s *configStore) Update(fn func(config []byte) ([]byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	config, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	newConfig, err := fn(config)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(config, newConfig) {
+		if err := snapshotConfig(config); err != nil {
+			log.Println("保存历史版本失败：", err)
+		}
+	}
+	err = writeFileAtomic(s.path, newConfig, 0644)
+	s.cacheMu.Lock()
+	s.cache = nil
+	s.cacheMu.Unlock()
+	return err
+}
+
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmpName)
+		}
+	}()
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Chmod(perm); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, filename); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(filename)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
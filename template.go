@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 文件名模板中可以使用的字段，例如 {{date:2006/01}}/{{domain}}/{{title}}.md
+type nameFields struct {
+	Idx    int
+	Title  string
+	URL    string
+	Domain string
+	Create time.Time
+	Tags   []string
+}
+
+var (
+	matchTemplateField = regexp.MustCompile(`\{\{(\w+)(?::([^}]*))?\}\}`)
+	matchIdxPrefix     = regexp.MustCompile(`^(\d+)-(.*)$`)
+)
+
+func validateNameTemplate(tmpl string) error {
+	return validateTemplate(tmpl, "idx", "title", "domain", "date", "tags")
+}
+
+// fields 为模板中允许使用的字段
+func validateTemplate(tmpl string, fields ...string) error {
+	for _, m := range matchTemplateField.FindAllStringSubmatch(tmpl, -1) {
+		known := false
+		for _, field := range fields {
+			known = known || m[1] == field
+		}
+		if !known {
+			return fmt.Errorf("unknown template field: %q", m[0])
+		}
+	}
+	if rest := matchTemplateField.ReplaceAllString(tmpl, ""); strings.Contains(rest, "{{") || strings.Contains(rest, "}}") {
+		return fmt.Errorf("invalid template: %q", tmpl)
+	}
+	return nil
+}
+
+// 由请求中的标题等参数得到模板字段，title 中的 idx- 前缀和 ext 会被去掉；
+// 能找到 idx 对应的稍后读时，以其中的链接、创建时间和标签为准
+func newNameFields(title, ext, idx, rawURL, tags string) *nameFields {
+	title = strings.TrimSuffix(title, ext)
+	f := &nameFields{Title: title, Create: time.Now(), Tags: splitTags(tags)}
+	if m := matchIdxPrefix.FindStringSubmatch(title); m != nil {
+		if idx == "" {
+			idx = m[1]
+		}
+		f.Title = m[2]
+	}
+	f.Idx, _ = strconv.Atoi(idx)
+	if f.Idx > 0 && store != nil {
+		if config, err := store.CachedConfig(); err == nil {
+			if _, u := config.Find(f.Idx); u != nil {
+				if rawURL == "" {
+					rawURL = u.URL
+				}
+				if create, err := u.CreateTime(); err == nil {
+					f.Create = create
+				}
+				if len(f.Tags) == 0 {
+					f.Tags = u.Tags
+				}
+			}
+		}
+	}
+	f.URL = rawURL
+	if parsed, err := url.Parse(rawURL); err == nil {
+		f.Domain = strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+	}
+	return f
+}
+
+// 按模板生成相对路径，字段中的 / 不会产生子目录；结果不以 ext 结尾时自动加上
+func (f *nameFields) render(tmpl, ext string) string {
+	escape := strings.NewReplacer("/", "_", `\`, "_")
+	name := matchTemplateField.ReplaceAllStringFunc(tmpl, func(s string) string {
+		m := matchTemplateField.FindStringSubmatch(s)
+		// 日期格式中的 / 用于分隔目录
+		if m[1] == "date" {
+			return f.value(m[1], m[2])
+		}
+		return escape.Replace(f.value(m[1], m[2]))
+	})
+	if ext != "" && !strings.HasSuffix(name, ext) {
+		name += ext
+	}
+	return name
+}
+
+// 按模板生成文本，不做任何转义
+func (f *nameFields) expand(tmpl string) string {
+	return matchTemplateField.ReplaceAllStringFunc(tmpl, func(s string) string {
+		m := matchTemplateField.FindStringSubmatch(s)
+		return f.value(m[1], m[2])
+	})
+}
+
+// arg 为字段名后 : 之后的部分，目前只有 date 使用
+func (f *nameFields) value(field, arg string) string {
+	switch field {
+	case "idx":
+		if f.Idx > 0 {
+			return strconv.Itoa(f.Idx)
+		}
+		return ""
+	case "title":
+		return f.Title
+	case "url":
+		return f.URL
+	case "domain":
+		return f.Domain
+	case "date":
+		if arg == "" {
+			return f.Create.Format("2006-01-02")
+		}
+		return f.Create.Format(arg)
+	case "tags":
+		return strings.Join(f.Tags, ",")
+	}
+	return ""
+}
+
+// enhancedOutput 中的一个导出目录及其文件名模板
+type outputTarget struct {
+	Path     string
+	Template string
+}
+
+// 没有配置模板时使用经过 safeName 处理的 name，不会产生子目录；否则按模板生成
+func (t outputTarget) name(fields *nameFields, name, ext string) string {
+	if t.Template == "" {
+		return safeName(name)
+	}
+	return fields.render(t.Template, ext)
+}
+
+// 按模板导出的文件的原始文件名（如 123-标题.html）与实际路径的对应关系，
+// 保存在 syncPath 下的 names.json，供 /reading/ 和自动删除使用
+type nameMap struct {
+	mu    sync.Mutex
+	path  string
+	names map[string]string
+}
+
+var names *nameMap
+
+func openNameMap(path string) *nameMap {
+	m := &nameMap{path: path, names: map[string]string{}}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println(err)
+		}
+		return m
+	}
+	if err := json.Unmarshal(data, &m.names); err != nil {
+		log.Println(err)
+	}
+	return m
+}
+
+func (m *nameMap) save() error {
+	data, err := json.MarshalIndent(m.names, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path, data, 0644)
+}
+
+func (m *nameMap) Set(name, path string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.names[name] = path
+	if err := m.save(); err != nil {
+		log.Println(err)
+	}
+}
+
+// 返回 name 对应的路径，文件已不存在时返回空
+func (m *nameMap) Lookup(name string) string {
+	if m == nil {
+		return ""
+	}
+	m.mu.Lock()
+	path := m.names[name]
+	m.mu.Unlock()
+	if path == "" {
+		return ""
+	}
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+func (m *nameMap) Names() []string {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]string, 0, len(m.names))
+	for name := range m.names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// 删除以 idx- 开头的记录，返回对应的路径
+func (m *nameMap) RemoveIdx(idx int) []string {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var paths []string
+	prefix := fmt.Sprint(idx, "-")
+	for name, path := range m.names {
+		if strings.HasPrefix(name, prefix) {
+			paths = append(paths, path)
+			delete(m.names, name)
+		}
+	}
+	if len(paths) > 0 {
+		if err := m.save(); err != nil {
+			log.Println(err)
+		}
+	}
+	return paths
+}
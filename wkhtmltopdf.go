@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	wkhtmltopdfBins    []string
+	wkhtmltopdfTimeout time.Duration
+)
+
+var errBinNotAllowed = errors.New("不允许使用的 wkhtmltopdf")
+
+// 允许客户端传入的 wkhtmltopdf 参数及其需要的值的个数；
+// 会读写本地文件或访问其他地址的参数（如 --enable-local-file-access、--allow、--post-file、
+// --header-html、--user-style-sheet、--dump-outline）以及 --enable-javascript 等 JavaScript 相关的参数不在其中
+var wkhtmltopdfFlags = map[string]int{
+	"-s": 1, "--page-size": 1, "--page-width": 1, "--page-height": 1,
+	"-O": 1, "--orientation": 1,
+	"-T": 1, "--margin-top": 1, "-B": 1, "--margin-bottom": 1,
+	"-L": 1, "--margin-left": 1, "-R": 1, "--margin-right": 1,
+	"-d": 1, "--dpi": 1, "--image-dpi": 1, "--image-quality": 1,
+	"--encoding": 1, "--zoom": 1, "--minimum-font-size": 1,
+	"--viewport-size": 1, "--title": 1, "--page-offset": 1, "--outline-depth": 1,
+	"--load-error-handling": 1, "--load-media-error-handling": 1,
+	"--header-left": 1, "--header-center": 1, "--header-right": 1,
+	"--header-font-name": 1, "--header-font-size": 1, "--header-spacing": 1,
+	"--footer-left": 1, "--footer-center": 1, "--footer-right": 1,
+	"--footer-font-name": 1, "--footer-font-size": 1, "--footer-spacing": 1,
+	"-g": 0, "--grayscale": 0, "-l": 0, "--lowquality": 0, "-q": 0, "--quiet": 0,
+	"--background": 0, "--no-background": 0, "--images": 0, "--no-images": 0,
+	"-n": 0, "--disable-javascript": 0,
+	"--print-media-type": 0, "--no-print-media-type": 0,
+	"--enable-smart-shrinking": 0, "--disable-smart-shrinking": 0,
+	"--enable-external-links": 0, "--disable-external-links": 0,
+	"--enable-internal-links": 0, "--disable-internal-links": 0,
+	"--enable-forms": 0, "--disable-forms": 0, "--stop-slow-scripts": 0,
+	"--outline": 0, "--no-outline": 0, "--no-pdf-compression": 0,
+	"--header-line": 0, "--no-header-line": 0, "--footer-line": 0, "--no-footer-line": 0,
+	"--default-header": 0, "--collate": 0, "--no-collate": 0,
+}
+
+// root 为空时使用 wkhtmltopdfBins 中的第一个，否则必须与其中之一完全相同
+func resolveWkhtmltopdf(root string) (string, error) {
+	if len(wkhtmltopdfBins) == 0 {
+		return "", errBinNotAllowed
+	}
+	if root == "" {
+		return wkhtmltopdfBins[0], nil
+	}
+	for _, bin := range wkhtmltopdfBins {
+		if root == bin {
+			return bin, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", errBinNotAllowed, root)
+}
+
+// 按 wkhtmltopdfFlags 检查客户端传来的以空格分隔的参数
+func parseWkhtmltopdfParams(s string) ([]string, error) {
+	fields := strings.Fields(s)
+	for i := 0; i < len(fields); i++ {
+		n, ok := wkhtmltopdfFlags[fields[i]]
+		if !ok {
+			return nil, fmt.Errorf("不允许使用的 wkhtmltopdf 参数：%s", fields[i])
+		}
+		if i+n >= len(fields) {
+			return nil, fmt.Errorf("wkhtmltopdf 参数缺少值：%s", fields[i])
+		}
+		for j := 1; j <= n; j++ {
+			if strings.HasPrefix(fields[i+j], "-") && !isNumber(fields[i+j]) {
+				return nil, fmt.Errorf("wkhtmltopdf 参数缺少值：%s", fields[i])
+			}
+		}
+		i += n
+	}
+	return fields, nil
+}
+
+func isNumber(s string) bool {
+	s = strings.TrimPrefix(s, "-")
+	return s != "" && strings.Trim(s, "0123456789.") == ""
+}
+
+// 在单独的临时目录中运行 wkhtmltopdf，超过 wkhtmltopdfTimeout 或 ctx 结束时结束进程，输出写入 logs；
+// 总是禁止读取本地文件，避免文章通过 file:// 把本机的文件嵌入 PDF；
+// wkhtmltopdf 默认执行 JavaScript，文章中的脚本可以发起任意请求，因此总是禁用
+func renderWkhtmltopdf(ctx context.Context, bin string, params []string, content string, logs io.Writer) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "simpread-wkhtmltopdf-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "in.html")
+	out := filepath.Join(dir, "out.pdf")
+	err = os.WriteFile(in, []byte(content), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, wkhtmltopdfTimeout)
+	defer cancel()
+	args := append([]string{"--disable-local-file-access", "--disable-javascript"}, params...)
+	cmd := exec.CommandContext(ctx, bin, append(args, in, out)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "TMPDIR="+dir, "HOME="+dir)
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+	// 子进程仍占用输出时不再等待
+	cmd.WaitDelay = time.Second
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("wkhtmltopdf 超时（%s）", wkhtmltopdfTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("wkhtmltopdf 运行失败：%w", err)
+	}
+	return os.ReadFile(out)
+}
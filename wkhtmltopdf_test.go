@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseWkhtmltopdfParams(t *testing.T) {
+	tests := []struct {
+		params string
+		want   []string
+		err    bool
+	}{
+		{"", []string{}, false},
+		{"-s A5 --margin-top -5 --grayscale", []string{"-s", "A5", "--margin-top", "-5", "--grayscale"}, false},
+		{"--enable-javascript", nil, true},
+		{"--javascript-delay 1000", nil, true},
+		{"--no-stop-slow-scripts", nil, true},
+		{"--enable-local-file-access", nil, true},
+		{"--allow /", nil, true},
+		{"--user-style-sheet /etc/passwd", nil, true},
+		{"--page-size", nil, true},
+		{"--title --grayscale", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseWkhtmltopdfParams(tt.params)
+		if (err != nil) != tt.err || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseWkhtmltopdfParams(%q) = %q, %v", tt.params, got, err)
+		}
+	}
+}
+
+// 用脚本代替 wkhtmltopdf，把收到的参数写入输出文件
+func TestRenderWkhtmltopdf(t *testing.T) {
+	wkhtmltopdfTimeout = 10 * time.Second
+	bin := filepath.Join(t.TempDir(), "wkhtmltopdf")
+	err := os.WriteFile(bin, []byte("#!/bin/sh\nfor out; do :; done\necho \"$@\" > \"$out\"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := renderWkhtmltopdf(context.Background(), bin, []string{"--grayscale"}, "<p>hi</p>", &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("--disable-local-file-access --disable-javascript --grayscale ")) {
+		t.Errorf("wkhtmltopdf args: %s", data)
+	}
+}